@@ -2,34 +2,55 @@ package backup
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"gpdbbr/cmd"
-	"io/ioutil"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"gopkg.in/yaml.v3"
-
 	"github.com/minio/minio-go/v7"
+	"gopkg.in/yaml.v3"
 )
 
 func DoBackup() {
+	// 同一个s3目录同时只能有一个备份
+	if !cmd.ArgConfig.DryRun {
+		cmd.AcquireBkLock(cmd.ArgConfig.BreakLock)
+	}
+	putlastsuccess()
+
 	// 判断备份类型
 	getbktype()
 	if BackupType == "full" {
-		cmd.LogInfo("Backup type = full backup")
+		cmd.LogInfo("Backup type = full backup, starting new backup chain")
 	} else {
 		cmd.LogInfo("Backup type = incremental backup")
 	}
 
+	// 断点续传
+	if cmd.ArgConfig.Resume != "" {
+		getprogress()
+	}
+
 	// 执行备份
 	commbackup()
 
+	if cmd.ArgConfig.DryRun {
+		printplan()
+		return
+	}
+
 	// 写入状态
 	BkResult.JobInfo.DBName = cmd.ArgConfig.DbName
+	BkResult.JobInfo.BackupType = BackupType
+	// 全量备份开始一个新的备份链, 增量备份沿用上一个备份集的备份链
+	if BackupType == "full" {
+		BkResult.JobInfo.ChainId = Timestamp
+	} else {
+		BkResult.JobInfo.ChainId = IncrYaml.JobInfo.ChainId
+	}
 	BkResult.JobInfo.BeginTime = Timestamp
 	if len(BkResult.FailTables) > 0 {
 		BkResult.JobInfo.Status = "warning"
@@ -37,125 +58,108 @@ func DoBackup() {
 		BkResult.JobInfo.Status = "success"
 	}
 
+	BkResult.TableFilter = cmd.ArgConfig.Filter
+	BkResult.JobInfo.KeyFingerprint = cmd.KeyFingerprint(cmd.CryptKey)
+	BkResult.JobInfo.KeySalt = cmd.KeySalt()
 	BkResult.JobInfo.EndTime = time.Now().Format("20060102150405000")
 
 	yamldata, err := yaml.Marshal(BkResult)
 	if err != nil {
 		cmd.LogError("Failed to marshal backup result to yaml: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
-	err = os.WriteFile(fmt.Sprintf("/tmp/bkresult_%s.yaml", Timestamp), yamldata, 0644)
+	bkresultfile := cmd.WorkFile(fmt.Sprintf("bkresult_%s.yaml", Timestamp))
+	err = os.WriteFile(bkresultfile, yamldata, 0600)
 	if err != nil {
 		cmd.LogError("Failed to write backup result to file: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	cmd.LogInfo("Write backup job information to %s/backups/%s/%s/gpdbbr_%s_jobinfo.yaml", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp)
-	cmd.PutFileToS3(fmt.Sprintf("/tmp/bkresult_%s.yaml", Timestamp), fmt.Sprintf("%s/backups/%s/%s/gpdbbr_%s_jobinfo.yaml", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp))
+	cmd.PutFileToS3(bkresultfile, fmt.Sprintf("%s/backups/%s/%s/gpdbbr_%s_jobinfo.yaml", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp))
+	cmd.RemoveWorkFile(bkresultfile)
+
+	// 备份完成, 删除进度文件
+	s3client := cmd.CreS3Client()
+	err = s3client.RemoveObject(context.Background(), cmd.ArgConfig.S3Bucket, cmd.BkSetProgressFile(cmd.BkSet{Date: BackupDate, Time: Timestamp}), minio.RemoveObjectOptions{})
+	if err != nil {
+		cmd.LogError("Failed to remove backup progress file: %s", err.Error())
+	}
 
 	if BkResult.JobInfo.Status == "success" {
 		cmd.LogInfo("Backup completed successfully")
 	} else {
 		cmd.LogInfo("Backup completed with failed tables")
 	}
+	putmetrics()
+
+	cmd.Notify(cmd.Notification{
+		Timestamp:  Timestamp,
+		Status:     BkResult.JobInfo.Status,
+		FailTables: BkResult.FailTables,
+	})
 }
 
 func getbktype() {
 	cmd.LogInfo("Checking backup type")
-	// 创建minio客户端
-	s3client := cmd.CreS3Client()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// 列出日期目录
-	var datedirs []int
-	datedirobjects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
-		Prefix:    fmt.Sprintf("%s/backups/", cmd.ArgConfig.S3Folder),
-		Recursive: false,
-	})
-
-	for datedir := range datedirobjects {
-		if datedir.Err != nil {
-			BackupType = "full"
-			return
-		}
-		datedirname, err := strconv.Atoi(strings.Split(datedir.Key, "/")[2])
-		if err != nil {
-			cmd.LogError("The s3 contains unknown files: %s", datedir.Key)
-			os.Exit(1)
-		}
-		datedirs = append(datedirs, datedirname)
-	}
-
-	// 如果没有日期目录，那么表示全量备份
-	if len(datedirs) == 0 {
+	// 指定了全量备份
+	if cmd.ArgConfig.Full {
 		BackupType = "full"
 		return
 	}
 
-	// 判断增量备份格式是否正常
-	// 取出最大日期
-	maxdate := datedirs[0]
-	for _, datenum := range datedirs {
-		if datenum > maxdate {
-			maxdate = datenum
-		}
-	}
-
-	// 取出最大时间
-	var timedirs []int
-	timedirobjects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
-		Prefix:    fmt.Sprintf("%s/backups/%d/", cmd.ArgConfig.S3Folder, maxdate),
-		Recursive: false,
-	})
-
-	for timedir := range timedirobjects {
-		timedirname, err := strconv.Atoi(strings.Split(timedir.Key, "/")[3])
-		if err != nil {
-			cmd.LogError("The s3 contains unknown files: %s", timedir.Key)
-			os.Exit(1)
-		}
-		timedirs = append(timedirs, timedirname)
-	}
-
-	maxtime := timedirs[0]
-	for _, timenum := range timedirs {
-		if timenum > maxtime {
-			maxtime = timenum
-		}
-	}
+	// 创建minio客户端
+	s3client := cmd.CreS3Client()
 
-	// 校验gpdbbr源数据文件
-	metafile := fmt.Sprintf("%s/backups/%d/%d/gpdbbr_%d_jobinfo.yaml", cmd.ArgConfig.S3Folder, maxdate, maxtime, maxtime)
-	backup_metadata_object, err := s3client.GetObject(ctx, cmd.ArgConfig.S3Bucket, metafile, minio.GetObjectOptions{})
+	// 列出备份集
+	sets, err := cmd.ListBkSets(s3client)
 	if err != nil {
-		cmd.LogError("Failed to get backup metadata file(%s): %s", metafile, err.Error())
-		os.Exit(1)
+		cmd.LogError("Failed to list backup sets: %s", err.Error())
+		cmd.Exit(1)
 	}
-	defer backup_metadata_object.Close()
 
-	backup_metadata, err := ioutil.ReadAll(backup_metadata_object)
-	if err != nil {
-		cmd.LogError("Failed to read backup metadata file(%s): %s", metafile, err.Error())
-		os.Exit(1)
+	// 校验最新备份集的gpdbbr源数据文件, 没有jobinfo文件的备份集是中断的备份, 跳过
+	var lastset *cmd.BkSet
+	for i := len(sets) - 1; i >= 0; i-- {
+		IncrYaml, err = cmd.GetBkMeta(s3client, sets[i])
+		if err == nil {
+			lastset = &sets[i]
+			break
+		}
+		if !cmd.IsNoSuchKey(err) {
+			cmd.LogError("Failed to get backup metadata file(%s): %s", cmd.BkSetMetaFile(sets[i]), err.Error())
+			cmd.Exit(1)
+		}
+		cmd.LogInfo("Skipping incomplete backup %s", sets[i].Time)
 	}
 
-	if err := yaml.Unmarshal(backup_metadata, &IncrYaml); err != nil {
-		cmd.LogError("Failed to unmarshal backup metadata file(%s): %s", metafile, err.Error())
-		os.Exit(1)
+	// 如果没有备份集，那么表示全量备份
+	if lastset == nil {
+		BackupType = "full"
+		return
 	}
+	BaseTime = lastset.Time
 
 	// 判断dbname是否和传入一直
 	if IncrYaml.JobInfo.DBName != cmd.ArgConfig.DbName {
 		cmd.LogError("Metafile dbname(%s) not equal to the dbname in the command line arguments", IncrYaml.JobInfo.DBName)
-		os.Exit(1)
+		cmd.Exit(1)
+	}
+
+	// 增量备份沿用备份链的口令盐值, 整个备份链使用相同的密钥
+	if err := cmd.UseKeySalt(IncrYaml.JobInfo.KeySalt); err != nil {
+		cmd.LogError("Failed to derive encryption key of backup %s: %s", lastset.Time, err.Error())
+		cmd.Exit(1)
 	}
 
-	// 判断任务状态
+	// 上一次备份失败的表, 在本次备份中强制备份
+	CarryTabs = make(map[string]bool)
 	if IncrYaml.JobInfo.Status == "warning" {
-		cmd.LogError("Previous backup job status is warning")
-		os.Exit(1)
+		cmd.LogInfo("Previous backup job status is warning, carrying forward failed tables: %s", strings.Join(IncrYaml.FailTables, ", "))
+		for _, tabname := range IncrYaml.FailTables {
+			CarryTabs[tabname] = true
+		}
 	}
 
 	BackupType = "increment"
@@ -171,7 +175,7 @@ func commbackup() {
 	err := dbconn.QueryRow("select version()").Scan(&dbversion)
 	if err != nil {
 		cmd.LogError("Failed to get Database Version: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	dbvbegin := strings.Index(dbversion, "Greenplum Database ")
@@ -185,20 +189,20 @@ func commbackup() {
 	err = dbconn.QueryRow(fmt.Sprintf("select oid from pg_database where datname = '%s'", cmd.ArgConfig.DbName)).Scan(&DbOid)
 	if err != nil {
 		cmd.LogError("Failed to get Database OID: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 获取catalog version number
 	cndir := os.Getenv("COORDINATOR_DATA_DIRECTORY")
 	if cndir == "" {
 		cmd.LogError("Failed to get COORDINATOR_DATA_DIRECTORY environment variable")
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	ok, controldata := cmd.ExecOsCmd("pg_controldata", []string{"-D", cndir})
 	if !ok {
 		cmd.LogError("Failed to get database catalog version number: %s", controldata)
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	lines := strings.Split(controldata, "\n")
@@ -213,21 +217,57 @@ func commbackup() {
 	GpHome = os.Getenv("GPHOME")
 	if GpHome == "" {
 		cmd.LogError("Failed to get GPHOME environment variable")
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 做一个检查点
 	_, err = dbconn.Exec("checkpoint")
 	if err != nil {
 		cmd.LogError("Failed to execute checkpoint: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
+	}
+
+	// 导出快照的事务随中断的任务结束, 快照不存在时使用新的快照继续备份
+	// 中断前完成的表在新的快照下没有变化时, 沿用已经上传的数据文件
+	if Progress != nil && !checksnapshot(dbconn, Progress.SnapShot) {
+		cmd.LogInfo("Snapshot of backup %s no longer exists, revalidating %d completed tables under a new snapshot", ResumeSet.Time, len(Progress.IncrementalMetadata.AO)+len(Progress.IncrementalMetadata.Heap))
+		ReuseEntries = make(map[string]cmd.DataEntry)
+		for _, entry := range Progress.DataEntries {
+			ReuseEntries[entry.TableName] = entry
+		}
+		ReuseMeta = Progress.IncrementalMetadata
+		Progress = nil
+	}
+
+	// 在获取快照之前收集heap表变化信息, 快照之后的变化会在下一次备份中发现
+	// 断点续传时使用原来的快照之前收集的信息, 否则快照之后的变化会被遗漏
+	var insertonlytabs map[string]string
+	var locktx *sql.Tx
+	if Progress != nil {
+		HeapCounters = Progress.HeapCounters
+		HeapStats = Progress.HeapStats
+	} else {
+		if cmd.ArgConfig.HeapDetector == "counter" {
+			cmd.LogInfo("Gathering heap table statistics counters")
+			HeapCounters = getheapcounters(dbconn)
+		} else if cmd.ArgConfig.HeapDetector == "pgstatfile" {
+			cmd.LogInfo("Gathering heap table file modification time")
+			getheapfilestats(dbconn)
+		}
+
+		// 获取快照期间阻塞只插入表的写入, 使segment本地快照和导出的快照看到相同的数据
+		insertonlytabs = getinsertonly(dbconn)
+		if len(insertonlytabs) > 0 && !cmd.ArgConfig.DryRun {
+			cmd.LogInfo("Locking %d insert-only tables in SHARE mode while taking the snapshot", len(insertonlytabs))
+			locktx = lockinsertonly(dbconn, insertonlytabs)
+		}
 	}
 
 	// 开启事务, 设置事务隔离级别
 	dbtx, err := dbconn.Begin()
 	if err != nil {
 		cmd.LogError("Failed to begin transaction: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer func() {
 		if err != nil {
@@ -245,28 +285,97 @@ func commbackup() {
 		`)
 	if err != nil {
 		cmd.LogError("Failed to init transaction information: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
-	// 获取unix时间戳, 时间戳, 事务快照ID
-	err = dbtx.QueryRow(`
-	SELECT FLOOR(EXTRACT(EPOCH FROM NOW()))::BIGINT AS unix_timestamp, 
-	TO_CHAR(CURRENT_TIMESTAMP, 'YYYYMMDDHH24MISSMS') AS formatted_time,
-	TO_CHAR(CURRENT_TIMESTAMP, 'YYYYMMDD') AS formatted_date,
-	pg_export_snapshot() AS snap_id;
-	`).Scan(&UnixTime, &Timestamp, &BackupDate, &DbSnapShot)
-	if err != nil {
-		cmd.LogError("Failed to get unix timestamp, timestamp, transaction snapshot id: %s", err.Error())
-		os.Exit(1)
+	if Progress != nil {
+		// 断点续传, 导入原来的快照, 沿用原来的时间戳
+		_, err = dbtx.Exec(fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", Progress.SnapShot))
+		if err != nil {
+			cmd.LogError("Failed to import snapshot of backup %s: %s", ResumeSet.Time, err.Error())
+			cmd.Exit(1)
+		}
+		UnixTime = Progress.UnixTime
+		Timestamp = ResumeSet.Time
+		BackupDate = ResumeSet.Date
+		DbSnapShot = Progress.SnapShot
+
+		BkResult.DataEntries = Progress.DataEntries
+		BkResult.DdlSqls = Progress.DdlSqls
+		BkResult.IncrementalMetadata = Progress.IncrementalMetadata
+		BkResult.SegSnapshots = Progress.SegSnapshots
+		SnapCounters = Progress.SnapCounters
+		cmd.LogInfo("Resuming backup, %d tables already completed", len(Progress.IncrementalMetadata.AO)+len(Progress.IncrementalMetadata.Heap))
+	} else {
+		// 获取unix时间戳, 时间戳, 事务快照ID
+		err = dbtx.QueryRow(`
+		SELECT FLOOR(EXTRACT(EPOCH FROM NOW()))::BIGINT AS unix_timestamp, 
+		TO_CHAR(CURRENT_TIMESTAMP, 'YYYYMMDDHH24MISSMS') AS formatted_time,
+		TO_CHAR(CURRENT_TIMESTAMP, 'YYYYMMDD') AS formatted_date,
+		pg_export_snapshot() AS snap_id;
+		`).Scan(&UnixTime, &Timestamp, &BackupDate, &DbSnapShot)
+		if err != nil {
+			cmd.LogError("Failed to get unix timestamp, timestamp, transaction snapshot id: %s", err.Error())
+			cmd.Exit(1)
+		}
+		// 沿用中断的备份集, 已经上传的数据文件在该备份集目录下
+		if ReuseEntries != nil {
+			Timestamp = ResumeSet.Time
+			BackupDate = ResumeSet.Date
+		}
+
+		// 记录每个segment的本地快照, 下一次备份用于找出只插入表新增的数据
+		// 本地快照晚于导出的快照, 只有持有锁期间没有写入的只插入表两者看到的数据相同
+		var snaprows *sql.Rows
+		snaprows, err = dbtx.Query("SELECT gp_segment_id, txid_current_snapshot()::text FROM gp_dist_random('gp_id')")
+		if err != nil {
+			cmd.LogError("Failed to get segment snapshots: %s", err.Error())
+			cmd.Exit(1)
+		}
+		BkResult.SegSnapshots = make(map[int]string)
+		for snaprows.Next() {
+			var segid int
+			var snap string
+			err = snaprows.Scan(&segid, &snap)
+			if err != nil {
+				cmd.LogError("Failed to get segment snapshots: %s", err.Error())
+				cmd.Exit(1)
+			}
+			BkResult.SegSnapshots[segid] = snap
+		}
+		snaprows.Close()
+
+		// 在快照之后收集只插入表的统计信息计数, 快照之前的更新和删除都会被发现
+		SnapCounters = make(map[string]cmd.HeapMetadata)
+		if len(insertonlytabs) > 0 {
+			counters := getheapcounters(dbconn)
+			for oid := range insertonlytabs {
+				heapmeta := counters[oid]
+				heapmeta.DeltaBase = locktx != nil
+				SnapCounters[oid] = heapmeta
+			}
+		}
+		if locktx != nil {
+			if err := locktx.Commit(); err != nil {
+				cmd.LogError("Failed to release insert-only table locks: %s", err.Error())
+				cmd.Exit(1)
+			}
+		}
 	}
+	cmd.SetLogTimestamp(Timestamp)
 	cmd.LogInfo("Backup Timestamp = %s", Timestamp)
+	if !cmd.ArgConfig.DryRun {
+		cmd.InitWorkDir(Timestamp)
+		// 上传任务日志到备份集目录
+		cmd.PutJobLogOnExit(cmd.BkSet{Date: BackupDate, Time: Timestamp}, "backup")
+	}
 
 	// 初始化SSH会话
 	cmd.LogInfo("Initializing SSH sessions")
 	rows, err := dbconn.Query("select distinct hostname from gp_segment_configuration where role = 'p' and content <> '-1'")
 	if err != nil {
 		cmd.LogError("Failed to get host lists: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	for rows.Next() {
@@ -274,16 +383,25 @@ func commbackup() {
 		err = rows.Scan(&host)
 		if err != nil {
 			cmd.LogError("Failed to get host lists: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		HostList = append(HostList, host)
 	}
 
-	cmd.InitSess(HostList)
+	if cmd.ArgConfig.HeapDetector == "stat" {
+		cmd.InitSess(HostList)
+	}
 
-	// 下发s3配置文件
-	cmd.LogInfo("Distributing S3 configuration file to all hosts")
-	cmd.CreS3Yaml(Timestamp, GpHome, HostList)
+	// 下发s3配置文件, 只生成备份计划时不需要
+	if !cmd.ArgConfig.DryRun {
+		cmd.CheckSegDirOwner(dbconn)
+		cmd.LogInfo("Distributing S3 configuration file to all hosts")
+		cmd.CreS3Yaml(Timestamp, GpHome, HostList)
+	}
+	if len(cmd.CryptKey) > 0 && !cmd.ArgConfig.DryRun {
+		cmd.LogInfo("Distributing encryption key to all hosts, key fingerprint = %s", cmd.KeyFingerprint(cmd.CryptKey))
+		cmd.CreCryptFiles(Timestamp, HostList)
+	}
 
 	// lock表操作 : 无论备份类型，都锁定所有表
 	cmd.LogInfo("Gathering table state information")
@@ -298,49 +416,56 @@ func commbackup() {
 	AND n.nspname NOT IN ('gp_toolkit', 'information_schema', 'pg_aoseg', 'pg_bitmapindex', 'pg_catalog', 'logddl')
 	AND relkind IN ('r', 'p')
 	AND c.oid NOT IN (select objid from pg_depend where deptype = 'e')
+	` + cmd.FilterSql(cmd.ArgConfig.Filter, "n.nspname", "c.relname") + `
 	ORDER BY c.oid;
 	`
 	rows, err = dbtx.Query(getalltablename)
 	if err != nil {
 		cmd.LogError("Failed to get all table name: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
 	alltablelist, err := cmd.ProcessRows(rows)
 	if err != nil {
 		cmd.LogError("Failed to get all table name: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 锁表
-	locksql := "LOCK TABLE "
-	for _, table := range alltablelist {
-		locksql = locksql + fmt.Sprintf("%v", table["tablename"]) + ", "
-	}
-	locksql = locksql[:len(locksql)-2] + " IN ACCESS SHARE MODE COORDINATOR ONLY"
-	cmd.LogInfo("Acquiring ACCESS SHARE locks on all tables")
-	_, err = dbtx.Exec(locksql)
-	if err != nil {
-		cmd.LogError("Failed to lock all table: %s", err.Error())
-		os.Exit(1)
+	if len(alltablelist) > 0 {
+		locksql := "LOCK TABLE "
+		for _, table := range alltablelist {
+			locksql = locksql + fmt.Sprintf("%v", table["tablename"]) + ", "
+		}
+		locksql = locksql[:len(locksql)-2] + " IN ACCESS SHARE MODE COORDINATOR ONLY"
+		cmd.LogInfo("Acquiring ACCESS SHARE locks on all tables")
+		_, err = dbtx.Exec(locksql)
+		if err != nil {
+			cmd.LogError("Failed to lock all table: %s", err.Error())
+			cmd.Exit(1)
+		}
 	}
 
-	cmd.LogInfo("Metadata write to %s/backups/%s/%s/gpdbbr_%s_all_metadata.sql", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp)
 	// 另外起一个线程，调用os命令, 导出源数据库
 	var oswg sync.WaitGroup
-	oswg.Add(1)
-	go func() {
-		defer oswg.Done()
-		dumpmeta()
-	}()
+	if !cmd.ArgConfig.DryRun {
+		cmd.LogInfo("Metadata write to %s/backups/%s/%s/gpdbbr_%s_all_metadata.sql", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp)
+		oswg.Add(1)
+		go func() {
+			defer oswg.Done()
+			defer cmd.Recover()
+			dumpmeta()
+		}()
+	}
 
 	cmd.LogInfo("Gathering additional table metadata")
 	// 排除分区表父表
 	gettablename := `
 	SELECT n.oid AS schemaoid,
 	c.oid AS oid,
-	quote_ident(n.nspname)||'.'||quote_ident(c.relname) as tablename 
+	quote_ident(n.nspname)||'.'||quote_ident(c.relname) as tablename,
+	(` + insertonlysql() + `) AS insertonly
 	FROM pg_class c
 	JOIN pg_namespace n ON c.relnamespace = n.oid
 	WHERE n.nspname NOT LIKE 'pg_temp_%' 
@@ -349,20 +474,21 @@ func commbackup() {
 	AND relkind IN ('r', 'p')
 	AND c.relfilenode <> 0
 	AND c.oid NOT IN (select objid from pg_depend where deptype = 'e')
+	` + cmd.FilterSql(cmd.ArgConfig.Filter, "n.nspname", "c.relname") + `
 	ORDER BY c.oid;
 	`
 
 	rows, err = dbtx.Query(gettablename)
 	if err != nil {
 		cmd.LogError("Failed to get table name: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
 	tablelist, err := cmd.ProcessRows(rows)
 	if err != nil {
 		cmd.LogError("Failed to get table name: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 构造列信息
@@ -378,6 +504,7 @@ func commbackup() {
 	AND c.reltype <> 0
 	AND a.attnum > 0::pg_catalog.int2
 	AND a.attisdropped = 'f'
+	` + cmd.FilterSql(cmd.ArgConfig.Filter, "n.nspname", "c.relname") + `
 	group by a.attrelid
 	ORDER BY a.attrelid;
 	`
@@ -385,14 +512,14 @@ func commbackup() {
 	rows, err = dbtx.Query(getcolname)
 	if err != nil {
 		cmd.LogError("Failed to get table column name: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
 	collist, err := cmd.ProcessRows(rows)
 	if err != nil {
 		cmd.LogError("Failed to get table column name: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 合并数据
@@ -423,14 +550,14 @@ func commbackup() {
 	rows, err = dbtx.Query(getddlsql)
 	if err != nil {
 		cmd.LogError("Failed to get ao table lastddltime: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
 	aoddllist, err := cmd.ProcessRows(rows)
 	if err != nil {
 		cmd.LogError("Failed to get ao table lastddltime: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 合并数据
@@ -439,14 +566,19 @@ func commbackup() {
 	// 获取ao表的aosegtablefqn
 	getaofqnsql := `
 	SELECT seg.aotablefqn as tablename,
-	'pg_aoseg.' || quote_ident(aoseg_c.relname) AS aosegtablefqn
+	'pg_aoseg.' || quote_ident(aoseg_c.relname) AS aosegtablefqn,
+	'pg_aoseg.' || quote_ident(visimap_c.relname) AS aovisimapfqn,
+	seg.amname AS aoamname
     FROM pg_class aoseg_c
     JOIN (SELECT pg_ao.relid AS aooid,
 	pg_ao.segrelid,
-	aotables.aotablefqn
+	pg_ao.visimaprelid,
+	aotables.aotablefqn,
+	aotables.amname
 	FROM pg_appendonly pg_ao
 	JOIN (SELECT c.oid,
-	quote_ident(n.nspname) || '.' || quote_ident(c.relname) AS aotablefqn
+	quote_ident(n.nspname) || '.' || quote_ident(c.relname) AS aotablefqn,
+	a.amname
 	FROM pg_class c
 	JOIN pg_namespace n ON c.relnamespace = n.oid
     JOIN pg_am a ON c.relam = a.oid
@@ -455,20 +587,21 @@ func commbackup() {
 	AND n.nspname NOT LIKE 'pg_toast%' 
 	AND n.nspname NOT IN ('gp_toolkit', 'information_schema', 'pg_aoseg', 'pg_bitmapindex', 'pg_catalog', 'logddl')) aotables 
 	ON pg_ao.relid = aotables.oid) seg 
-	ON aoseg_c.oid = seg.segrelid;
+	ON aoseg_c.oid = seg.segrelid
+	JOIN pg_class visimap_c ON visimap_c.oid = seg.visimaprelid;
 	`
 
 	rows, err = dbtx.Query(getaofqnsql)
 	if err != nil {
 		cmd.LogError("Failed to get ao table aosegtablefqn: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
 	aofqnlist, err := cmd.ProcessRows(rows)
 	if err != nil {
 		cmd.LogError("Failed to get ao table aosegtablefqn failed: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 合并数据
@@ -502,54 +635,54 @@ func commbackup() {
 		rows, err = dbtx.Query(getaoddl)
 		if err != nil {
 			cmd.LogError("Failed get ao table ddl: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		defer rows.Close()
 
 		aoddlsqllist, err := cmd.ProcessRows(rows)
 		if err != nil {
 			cmd.LogError("Failed get ao table ddl: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 
 		// 合并数据
 		tabinfolist = cmd.MergeSlices(tabinfolist, aoddlsqllist, "tablename")
 	}
 
-	// 放入通道
+	// 放入通道, 断点续传时跳过已经完成的表
 	dotablelist := make(chan map[string]interface{}, 1000000)
 	for _, row := range tabinfolist {
+		tabname := fmt.Sprintf("%v", row["tablename"])
+		if _, ok := BkResult.IncrementalMetadata.AO[tabname]; ok {
+			continue
+		}
+		if _, ok := BkResult.IncrementalMetadata.Heap[tabname]; ok {
+			continue
+		}
 		dotablelist <- row
 	}
 
-	cmd.LogInfo("Writing table data to s3 file")
+	if cmd.ArgConfig.DryRun {
+		cmd.LogInfo("Evaluating table changes")
+	} else {
+		cmd.LogInfo("Writing table data to s3 file")
+	}
 	var wg2 sync.WaitGroup
-	var mu sync.Mutex
-	BkResult.IncrementalMetadata.AO = make(map[string]cmd.AoMetadata)
-	BkResult.IncrementalMetadata.Heap = make(map[string]cmd.HeapMetadata)
+	if BkResult.IncrementalMetadata.AO == nil {
+		BkResult.IncrementalMetadata.AO = make(map[string]cmd.AoMetadata)
+	}
+	if BkResult.IncrementalMetadata.Heap == nil {
+		BkResult.IncrementalMetadata.Heap = make(map[string]cmd.HeapMetadata)
+	}
+	if !cmd.ArgConfig.DryRun {
+		startprogress()
+	}
 	for i := 0; i < cmd.ArgConfig.Jobs; i++ {
 		wg2.Add(1)
 		go func() {
 			defer wg2.Done()
-			failtab, incrinfo, dataent, ddls := workthread(dotablelist)
-
-			mu.Lock()
-			for _, v := range failtab {
-				BkResult.FailTables = append(BkResult.FailTables, v)
-			}
-			for k, v := range incrinfo.AO {
-				BkResult.IncrementalMetadata.AO[k] = v
-			}
-			for k, v := range incrinfo.Heap {
-				BkResult.IncrementalMetadata.Heap[k] = v
-			}
-			for _, v := range dataent {
-				BkResult.DataEntries = append(BkResult.DataEntries, v)
-			}
-			for _, v := range ddls {
-				BkResult.DdlSqls = append(BkResult.DdlSqls, v)
-			}
-			mu.Unlock()
+			defer cmd.Recover()
+			workthread(dotablelist)
 		}()
 	}
 
@@ -558,14 +691,36 @@ func commbackup() {
 	oswg.Wait()
 	wg2.Wait()
 
+	// 只生成备份计划, 不写入任何数据
+	if cmd.ArgConfig.DryRun {
+		return
+	}
+	stopprogress()
+
+	// 记录每个数据项上传的文件, 缺少文件的表视为备份失败
+	cmd.LogInfo("Recording uploaded data objects")
+	fillobjects()
+
+	// 记录补充备份的表
+	for _, v := range BkResult.DataEntries {
+		if CarryTabs[v.TableName] {
+			BkResult.CarriedTables = append(BkResult.CarriedTables, v.TableName)
+		}
+	}
+
 	// 备份增量表DDL
 	if BackupType == "increment" {
 		var tablist []string
-		if BkResult.DataEntries != nil {
-			tabsqlstr := "'" // 用于过滤分区表
-			for _, v := range BkResult.DataEntries {
+		for _, v := range BkResult.DataEntries {
+			// 只备份新增数据的表结构没有变化, 恢复时不删除重建
+			if !v.Delta {
 				tablist = append(tablist, v.TableName)
-				tabsqlstr += v.TableName + "','"
+			}
+		}
+		if len(tablist) > 0 {
+			tabsqlstr := "'" // 用于过滤分区表
+			for _, v := range tablist {
+				tabsqlstr += v + "','"
 			}
 			// 所有子分区都增量备份了, 那么父分区也需要增量备份
 			tabsqlstr = tabsqlstr[:len(tabsqlstr)-2]
@@ -583,7 +738,7 @@ func commbackup() {
 			rows, err = dbconn.Query(getpnamesql)
 			if err != nil {
 				cmd.LogError("Failed to get parent table name: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 			defer rows.Close()
 
@@ -592,7 +747,7 @@ func commbackup() {
 				err = rows.Scan(&parentname)
 				if err != nil {
 					cmd.LogError("Failed to get parent table name: %s", err.Error())
-					os.Exit(1)
+					cmd.Exit(1)
 				}
 				tablist = append(tablist, parentname)
 			}
@@ -605,13 +760,14 @@ func commbackup() {
 		JOIN pg_class parent ON pt.partrelid = parent.oid
 		JOIN pg_namespace pnp on parent.relnamespace = pnp.oid
 		LEFT JOIN pg_inherits i ON i.inhparent = parent.oid
-		WHERE i.inhrelid IS NULL;
+		WHERE i.inhrelid IS NULL
+		` + cmd.FilterSql(cmd.ArgConfig.Filter, "pnp.nspname", "parent.relname") + `;
 		`
 
 		rows, err = dbconn.Query(getnullpnamesql)
 		if err != nil {
 			cmd.LogError("Failed to get parent table name: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		defer rows.Close()
 
@@ -620,7 +776,7 @@ func commbackup() {
 			err = rows.Scan(&parentname)
 			if err != nil {
 				cmd.LogError("Failed to get parent table name: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 			tablist = append(tablist, parentname)
 		}
@@ -638,7 +794,7 @@ func commbackup() {
 	rows, err = dbconn.Query(getusersql)
 	if err != nil {
 		cmd.LogError("Failed to get users: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
@@ -647,7 +803,7 @@ func commbackup() {
 		err = rows.Scan(&username)
 		if err != nil {
 			cmd.LogError("Failed to get users failed: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		BkResult.UserList = append(BkResult.UserList, username)
 	}
@@ -658,15 +814,15 @@ func commbackup() {
 	_, err = dbconn.Exec(purgeddllog)
 	if err != nil {
 		cmd.LogError("Failed to Clean ddl log table: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 获取表的行统计信息
 	cmd.LogInfo("Getting table row statistics")
-	rows, err = dbconn.Query("select schemaname||'.'||relname as tabname, n_live_tup as tabrow from pg_stat_all_tables where schemaname not in ('logddl', 'information_schema') and schemaname not like 'pg%'")
+	rows, err = dbconn.Query("select schemaname||'.'||relname as tabname, n_live_tup as tabrow from pg_stat_all_tables where schemaname not in ('logddl', 'information_schema') and schemaname not like 'pg%' " + cmd.FilterSql(cmd.ArgConfig.Filter, "schemaname", "relname"))
 	if err != nil {
 		cmd.LogError("Failed to get table row statistics: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
@@ -677,64 +833,55 @@ func commbackup() {
 		err = rows.Scan(&tabname, &tabrow)
 		if err != nil {
 			cmd.LogError("Failed to get table row statistics: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		BkResult.TableRows[tabname] = tabrow
 	}
 }
 
-func workthread(dotablelist chan map[string]interface{}) ([]string, cmd.IncrementalMetadata, []cmd.DataEntry, []string) {
+func workthread(dotablelist chan map[string]interface{}) {
 	dbconn := cmd.CreateDbConn(cmd.ArgConfig.DbName)
 	defer dbconn.Close()
 
-	var failtab []string
-	var incrinfo cmd.IncrementalMetadata
-	var dataent []cmd.DataEntry
-	var ddls []string
-	incrinfo.AO = make(map[string]cmd.AoMetadata)
-	incrinfo.Heap = make(map[string]cmd.HeapMetadata)
-
 	for table := range dotablelist {
+		tabname := table["tablename"].(string)
 		if table["aosegtablefqn"] != nil {
-			modcnt, lastsegddl, isbk, err := bkaotabl(dbconn, table)
+			aometa, lastsegddl, reason, isbk, err := bkaotabl(dbconn, table)
+			ResultMu.Lock()
 			if err != nil {
-				failtab = append(failtab, table["tablename"].(string))
-				cmd.LogError("Backup AO table %s failed: %s", table["tablename"].(string), err.Error())
+				BkResult.FailTables = append(BkResult.FailTables, tabname)
+				cmd.LogErrorFields(cmd.LogFields{Table: tabname, Error: err.Error()}, "Backup AO table %s failed: %s", tabname, err.Error())
+				reason = "error: " + err.Error()
 			} else {
-				incrinfo.AO[table["tablename"].(string)] = cmd.AoMetadata{
-					ModCount:    modcnt,
-					LastDDLTime: table["lastddltimestamp"].(string),
-				}
+				aometa.LastDDLTime = table["lastddltimestamp"].(string)
+				BkResult.IncrementalMetadata.AO[tabname] = aometa
 				if isbk {
-					dataent = append(dataent, cmd.DataEntry{
-						TableName:       table["tablename"].(string),
-						OID:             table["oid"].(string),
-						AttributeString: table["colnameagg"].(string),
-					})
+					BkResult.DataEntries = append(BkResult.DataEntries, newentry(table, reason, aometa))
 				} else {
 					if lastsegddl != "" {
-						ddls = append(ddls, lastsegddl)
+						BkResult.DdlSqls = append(BkResult.DdlSqls, lastsegddl)
 					}
 				}
 			}
+			Plan = append(Plan, PlanItem{TableName: tabname, Kind: "ao", Backup: isbk, Reason: reason})
+			saveprogress(isbk)
+			ResultMu.Unlock()
 		} else {
-			maxstat, isbk, err := bkheaptable(dbconn, table)
+			heapmeta, reason, isbk, err := bkheaptable(dbconn, table)
+			ResultMu.Lock()
 			if err != nil {
-				failtab = append(failtab, table["tablename"].(string))
-				cmd.LogError("Backup heap table %s failed: %s", table["tablename"].(string), err.Error())
+				BkResult.FailTables = append(BkResult.FailTables, tabname)
+				cmd.LogErrorFields(cmd.LogFields{Table: tabname, Error: err.Error()}, "Backup heap table %s failed: %s", tabname, err.Error())
+				reason = "error: " + err.Error()
 			} else {
-				incrinfo.Heap[table["tablename"].(string)] = cmd.HeapMetadata{
-					MaxStat: maxstat,
-				}
+				BkResult.IncrementalMetadata.Heap[tabname] = heapmeta
 				if isbk {
-					dataent = append(dataent, cmd.DataEntry{
-						TableName:       table["tablename"].(string),
-						OID:             table["oid"].(string),
-						AttributeString: table["colnameagg"].(string),
-					})
+					BkResult.DataEntries = append(BkResult.DataEntries, newentry(table, reason, heapmeta))
 				}
 			}
+			Plan = append(Plan, PlanItem{TableName: tabname, Kind: "heap", Backup: isbk, Reason: reason})
+			saveprogress(isbk)
+			ResultMu.Unlock()
 		}
 	}
-	return failtab, incrinfo, dataent, ddls
 }
@@ -1,19 +1,35 @@
 package backup
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"gpdbbr/cmd"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
+
+	"github.com/minio/minio-go/v7"
+	"gopkg.in/yaml.v3"
 )
 
 func dumpmeta() {
-	ok, output := cmd.ExecOsCmd("pg_dump", []string{"-s", fmt.Sprintf("--snapshot=%s", DbSnapShot), cmd.ArgConfig.DbName, "-f", fmt.Sprintf("/tmp/gpdbbr_%s_all_metadata.sql", Timestamp)})
+	metadatafilepath := cmd.WorkFile(fmt.Sprintf("gpdbbr_%s_all_metadata.sql", Timestamp))
+	checkfreespace("all_metadata.sql")
+
+	dumparg := []string{"-s", fmt.Sprintf("--snapshot=%s", DbSnapShot), "-f", metadatafilepath}
+	dumparg = append(dumparg, cmd.DumpConnArgs(cmd.ArgConfig.DbName)...)
+	dumparg = append(dumparg, cmd.FilterDumpArgs(cmd.ArgConfig.Filter)...)
+	ok, output := cmd.ExecOsCmd("pg_dump", dumparg)
 	if !ok {
 		cmd.LogError("Dump metadata fail: %s\n", output)
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 需要单独导出函数和存储过程的源数据
@@ -23,7 +39,7 @@ func dumpmeta() {
 	dbtx, err := dbconn.Begin()
 	if err != nil {
 		cmd.LogError("Failed to begin transaction: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer func() {
 		if err != nil {
@@ -40,7 +56,7 @@ func dumpmeta() {
 	`, DbSnapShot))
 	if err != nil {
 		cmd.LogError("Failed to init transaction: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// // 获取所有的schema的oid
@@ -49,11 +65,12 @@ func dumpmeta() {
 	from pg_catalog.pg_namespace 
 	where nspname NOT LIKE 'pg_temp_%' 
 	AND nspname NOT LIKE 'pg_toast%' 
-	AND nspname NOT IN ('gp_toolkit', 'information_schema', 'pg_aoseg', 'pg_bitmapindex', 'pg_catalog');
+	AND nspname NOT IN ('gp_toolkit', 'information_schema', 'pg_aoseg', 'pg_bitmapindex', 'pg_catalog')
+	` + cmd.FilterSql(cmd.ArgConfig.Filter, "nspname", "") + `;
 	`)
 	if err != nil {
 		cmd.LogError("Failed get schema oid: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
@@ -63,17 +80,16 @@ func dumpmeta() {
 		err = rows.Scan(&schemaoid)
 		if err != nil {
 			cmd.LogError("Failed get schema oid: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		schemelist = append(schemelist, schemaoid)
 	}
 
 	// 打开源数据文件
-	metadatafilepath := fmt.Sprintf("/tmp/gpdbbr_%s_all_metadata.sql", Timestamp)
-	metadatafile, err := os.OpenFile(metadatafilepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	metadatafile, err := os.OpenFile(metadatafilepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		cmd.LogError("Failed to open metadata file: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer metadatafile.Close()
 
@@ -81,7 +97,7 @@ func dumpmeta() {
 		rows, err = dbtx.Query(fmt.Sprintf("select pg_get_functiondef(oid) from pg_catalog.pg_proc where pronamespace=%d::oid", schemaoid))
 		if err != nil {
 			cmd.LogError("Failed to get schema function definition: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		defer rows.Close()
 
@@ -90,40 +106,60 @@ func dumpmeta() {
 			err = rows.Scan(&funcsql)
 			if err != nil {
 				cmd.LogError("Failed to get schema function definition: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 
 			funcsql = funcsql + ";\n\n"
 			_, err = metadatafile.WriteString(funcsql)
 			if err != nil {
-				cmd.LogError("Failed to get schema function definition: %s", err.Error)
-				os.Exit(1)
+				cmd.LogError("Failed to get schema function definition: %s", err.Error())
+				cmd.Exit(1)
 			}
 		}
 	}
 
 	// 上传文件到s3
-	cmd.PutFileToS3(fmt.Sprintf("/tmp/gpdbbr_%s_all_metadata.sql", Timestamp), fmt.Sprintf("%s/backups/%s/%s/gpdbbr_%s_all_metadata.sql", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp))
+	cmd.PutFileToS3(metadatafilepath, fmt.Sprintf("%s/backups/%s/%s/gpdbbr_%s_all_metadata.sql", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp))
+	cmd.RemoveWorkFile(metadatafilepath)
+}
+
+// pg_dump前检查工作目录的剩余空间, 按上一个备份集同名文件大小的2倍估算
+func checkfreespace(name string) {
+	var need int64
+	if BaseTime != "" {
+		base := cmd.BkSet{Date: BaseTime[:8], Time: BaseTime}
+		need = 2 * cmd.S3ObjectSize(fmt.Sprintf("%sgpdbbr_%s_%s", cmd.BkSetPrefix(base), BaseTime, name))
+	}
+	if err := cmd.CheckFreeSpace(need); err != nil {
+		cmd.LogError("Not enough space for %s: %s", name, err.Error())
+		cmd.Exit(1)
+	}
 }
 
 func dumptabddl(tablist []string) {
-	dumparg := []string{"-s", fmt.Sprintf("--snapshot=%s", DbSnapShot), cmd.ArgConfig.DbName, "-f", fmt.Sprintf("/tmp/gpdbbr_%s_incr_metadata.sql", Timestamp)}
+	metadatafilepath := cmd.WorkFile(fmt.Sprintf("gpdbbr_%s_incr_metadata.sql", Timestamp))
+	checkfreespace("incr_metadata.sql")
+
+	dumparg := []string{"-s", fmt.Sprintf("--snapshot=%s", DbSnapShot), "-f", metadatafilepath}
+	dumparg = append(dumparg, cmd.DumpConnArgs(cmd.ArgConfig.DbName)...)
 	for _, tabname := range tablist {
 		dumparg = append(dumparg, "-t", tabname)
 	}
 	ok, output := cmd.ExecOsCmd("pg_dump", dumparg)
 	if !ok {
 		cmd.LogError("Failed to dump increment table ddl: %s", output)
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
-	cmd.PutFileToS3(fmt.Sprintf("/tmp/gpdbbr_%s_incr_metadata.sql", Timestamp), fmt.Sprintf("%s/backups/%s/%s/gpdbbr_%s_incr_metadata.sql", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp))
+	cmd.PutFileToS3(metadatafilepath, fmt.Sprintf("%s/backups/%s/%s/gpdbbr_%s_incr_metadata.sql", cmd.ArgConfig.S3Folder, BackupDate, Timestamp, Timestamp))
+	cmd.RemoveWorkFile(metadatafilepath)
 }
 
-func bkaotabl(dbconn *sql.DB, tabinfo map[string]interface{}) (int, string, bool, error) {
+func bkaotabl(dbconn *sql.DB, tabinfo map[string]interface{}) (cmd.AoMetadata, string, string, bool, error) {
+	var aometa cmd.AoMetadata
 	dbtx, err := dbconn.Begin()
 	if err != nil {
-		return 0, "", false, err
+		return aometa, "", "", false, err
 	}
 	defer func() {
 		if err != nil {
@@ -138,7 +174,7 @@ func bkaotabl(dbconn *sql.DB, tabinfo map[string]interface{}) (int, string, bool
 	SET TRANSACTION SNAPSHOT '%s';
 	`, DbSnapShot))
 	if err != nil {
-		return 0, "", false, err
+		return aometa, "", "", false, err
 	}
 
 	colnameagg := fmt.Sprintf("%v", tabinfo["colnameagg"])
@@ -156,50 +192,240 @@ func bkaotabl(dbconn *sql.DB, tabinfo map[string]interface{}) (int, string, bool
 	var modcount int
 	err = dbtx.QueryRow(fmt.Sprintf("SELECT COALESCE(pg_catalog.sum(modcount), 0) AS modcount FROM gp_dist_random('%v')", tabinfo["aosegtablefqn"])).Scan(&modcount)
 	if err != nil {
-		return 0, "", false, fmt.Errorf("Failed to get AO table modcount: %s", err.Error())
+		return aometa, "", "", false, fmt.Errorf("Failed to get AO table modcount: %s", err.Error())
+	}
+	aometa.ModCount = modcount
+
+	// 获取每个segfile的状态和可见性映射表摘要
+	err = getaosegfiles(dbtx, tabinfo, &aometa)
+	if err != nil {
+		return aometa, "", "", false, err
 	}
 
 	var isbackupable bool
+	var reason string
+	var delta map[[2]int]int64
+	premeta, existed := IncrYaml.IncrementalMetadata.AO[tablename]
 	if BackupType == "full" {
-		isbackupable = true
+		isbackupable, reason = true, ReasonFull
+	} else if CarryTabs[tablename] {
+		isbackupable, reason = true, ReasonCarried
+	} else if !existed {
+		isbackupable, reason = true, ReasonNewTable
 	} else {
-		if modcount != IncrYaml.IncrementalMetadata.AO[tablename].ModCount {
-			isbackupable = true
+		if modcount != premeta.ModCount {
+			isbackupable, reason = true, ReasonModCount
+			// 没有DDL并且只有追加, 只备份新增的数据
+			if lastddltime == premeta.LastDDLTime {
+				delta = aoappends(aometa, premeta)
+				if delta != nil {
+					reason = ReasonAppended
+				}
+			}
 		} else {
-			if lastddltime == IncrYaml.IncrementalMetadata.AO[tablename].LastDDLTime {
+			if lastddltime == premeta.LastDDLTime {
 				isbackupable = false
-				return modcount, "", false, nil
+				return aometa, "", ReasonUnchanged, false, nil
 			} else {
 				if lastsegddl != "" {
 					isbackupable = false
-					return modcount, lastsegddl, false, nil
+					return aometa, lastsegddl, ReasonDDLReplay, false, nil
 				} else {
-					isbackupable = true
+					isbackupable, reason = true, ReasonDDLTime
 				}
 			}
 		}
 	}
 
-	if isbackupable {
+	aometa.LastDDLTime = lastddltime
+	if _, ok := reusable(tablename, reason, aometa); ok && isbackupable {
+		cmd.LogInfoFields(cmd.LogFields{Table: tablename}, "AO table %s unchanged since the interrupted backup, reusing uploaded data", tablename)
+		return aometa, "", reason, true, nil
+	}
+
+	if isbackupable && !cmd.ArgConfig.DryRun {
 		copysql := fmt.Sprintf(`
-		COPY %s(%s) TO PROGRAM 'gzip -c -1 | %s/bin/gpbackup_s3_plugin backup_data /tmp/gpdbbr_%s_s3.yaml <SEG_DATA_DIR>/backups/%s/%s/gpdbbr_<SEGID>_%s_%s.gz' WITH CSV DELIMITER ',' ON SEGMENT IGNORE EXTERNAL PARTITIONS;
-		`, tablename, colnameagg, GpHome, Timestamp, BackupDate, Timestamp, Timestamp, tableoid)
+		COPY %s(%s) TO PROGRAM '%s' WITH CSV DELIMITER ',' ON SEGMENT IGNORE EXTERNAL PARTITIONS;
+		`, tablename, colnameagg, copyprogram(tableoid, tablename))
 		timestart := time.Now()
-		_, err = dbtx.Exec(copysql)
-		if err != nil {
-			return 0, "", false, fmt.Errorf("Failed to execute AO table backup sql: %s", err.Error())
+		if delta != nil {
+			var res sql.Result
+			res, err = dbtx.Exec(fmt.Sprintf(`
+			COPY (SELECT %s FROM %s WHERE %s) TO PROGRAM '%s' WITH CSV DELIMITER ',' ON SEGMENT;
+			`, colnameagg, tablename, aodeltafilter(delta, premeta), copyprogram(tableoid, tablename)))
+			if err != nil {
+				return aometa, "", "", false, fmt.Errorf("Failed to execute AO table backup sql: %s", err.Error())
+			}
+
+			// 上一个备份集记录行号时有正在写入的事务, 这些事务的行号不大于记录的行号, 行数不一致时备份整张表
+			var appended int64
+			for _, cnt := range delta {
+				appended += cnt
+			}
+			copied, _ := res.RowsAffected()
+			if copied != appended {
+				cmd.LogInfoFields(cmd.LogFields{Table: tablename}, "AO table %s copied %d appended rows, expected %d, backing up the whole table", tablename, copied, appended)
+				delta = nil
+				reason = ReasonModCount
+			}
+		}
+		if delta == nil {
+			_, err = dbtx.Exec(copysql)
+			if err != nil {
+				return aometa, "", "", false, fmt.Errorf("Failed to execute AO table backup sql: %s", err.Error())
+			}
 		}
 		duration := time.Since(timestart).Seconds()
-		cmd.LogInfo("Backup AO table done: %s, duration: %.2fs", tablename, duration)
+		if delta != nil {
+			cmd.LogInfoFields(cmd.LogFields{Table: tablename, Duration: duration}, "Backup AO table appended rows done: %s, duration: %.2fs", tablename, duration)
+		} else {
+			cmd.LogInfoFields(cmd.LogFields{Table: tablename, Duration: duration}, "Backup AO table done: %s, duration: %.2fs", tablename, duration)
+		}
+	}
+
+	return aometa, "", reason, true, nil
+}
+
+// AO表的行号: ctid 的块号高7位是segfile编号, 其余位和偏移量的低15位组成行号
+const (
+	aoctidblock  = "split_part(btrim(ctid::text, '()'), ',', 1)::bigint"
+	aoctidoffset = "split_part(btrim(ctid::text, '()'), ',', 2)::bigint"
+)
+
+var (
+	aosegnoexpr  = fmt.Sprintf("(%s >> 25)", aoctidblock)
+	aorownumexpr = fmt.Sprintf("(((%s & 33554431) << 15) | (%s & 32767))", aoctidblock, aoctidoffset)
+)
+
+// 获取AO表每个segfile的状态和可见性映射表摘要
+func getaosegfiles(dbtx *sql.Tx, tabinfo map[string]interface{}, aometa *cmd.AoMetadata) error {
+	// 列存表的segfile没有eof字段
+	eofcol := "eof"
+	if fmt.Sprintf("%v", tabinfo["aoamname"]) == "ao_column" {
+		eofcol = "0::bigint"
+	}
+	rows, err := dbtx.Query(fmt.Sprintf("SELECT gp_segment_id, segno, %s, tupcount, state FROM gp_dist_random('%v') ORDER BY 1, 2", eofcol, tabinfo["aosegtablefqn"]))
+	if err != nil {
+		return fmt.Errorf("Failed to get AO table segfiles: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var segfile cmd.AoSegFile
+		err = rows.Scan(&segfile.SegId, &segfile.SegNo, &segfile.Eof, &segfile.TupCount, &segfile.State)
+		if err != nil {
+			return fmt.Errorf("Failed to get AO table segfiles: %s", err.Error())
+		}
+		aometa.SegFiles = append(aometa.SegFiles, segfile)
 	}
 
-	return modcount, "", true, nil
+	// gp_fastsequence记录每个segfile已经分配的最大行号, 不受事务控制, 包含正在写入的事务分配的行号
+	rows, err = dbtx.Query(fmt.Sprintf("SELECT gp_segment_id, objmod, last_sequence FROM gp_dist_random('gp_fastsequence') WHERE objid = '%v'::regclass", tabinfo["aosegtablefqn"]))
+	if err != nil {
+		return fmt.Errorf("Failed to get AO table row numbers: %s", err.Error())
+	}
+	defer rows.Close()
+
+	lastrownums := make(map[[2]int]int64)
+	for rows.Next() {
+		var segid, segno int
+		var lastrownum int64
+		err = rows.Scan(&segid, &segno, &lastrownum)
+		if err != nil {
+			return fmt.Errorf("Failed to get AO table row numbers: %s", err.Error())
+		}
+		lastrownums[[2]int{segid, segno}] = lastrownum
+	}
+	for i, segfile := range aometa.SegFiles {
+		aometa.SegFiles[i].LastRowNum = lastrownums[[2]int{segfile.SegId, segfile.SegNo}]
+	}
+
+	err = dbtx.QueryRow(fmt.Sprintf(`
+	SELECT COALESCE(md5(string_agg(gp_segment_id||':'||segno||':'||first_row_no||':'||md5(visimap), ',' ORDER BY gp_segment_id, segno, first_row_no)), '')
+	FROM gp_dist_random('%v')
+	`, tabinfo["aovisimapfqn"])).Scan(&aometa.VisimapHash)
+	if err != nil {
+		return fmt.Errorf("Failed to get AO table visimap: %s", err.Error())
+	}
+	return nil
 }
 
-func bkheaptable(dbconn *sql.DB, tabinfo map[string]interface{}) (int, bool, error) {
+// AO表自上一个备份集之后是否只有追加, 返回每个segfile新增的行数, 不是只有追加时返回nil
+// 有删除或更新时可见性映射表会变化, 压缩时segfile的行数会减少或状态变化
+func aoappends(cur cmd.AoMetadata, pre cmd.AoMetadata) map[[2]int]int64 {
+	if len(pre.SegFiles) == 0 || cur.VisimapHash != pre.VisimapHash {
+		return nil
+	}
+
+	cursegs := make(map[[2]int]cmd.AoSegFile)
+	for _, segfile := range cur.SegFiles {
+		if segfile.State != 1 {
+			return nil
+		}
+		cursegs[[2]int{segfile.SegId, segfile.SegNo}] = segfile
+	}
+
+	delta := make(map[[2]int]int64)
+	for key, segfile := range cursegs {
+		delta[key] = segfile.TupCount
+	}
+	for _, presegfile := range pre.SegFiles {
+		key := [2]int{presegfile.SegId, presegfile.SegNo}
+		segfile, ok := cursegs[key]
+		if !ok || presegfile.State != 1 || segfile.TupCount < presegfile.TupCount || segfile.Eof < presegfile.Eof {
+			return nil
+		}
+		// 没有记录行号时无法区分新增的行
+		if presegfile.TupCount > 0 && presegfile.LastRowNum == 0 {
+			return nil
+		}
+		delta[key] = segfile.TupCount - presegfile.TupCount
+	}
+
+	var total int64
+	for key, cnt := range delta {
+		if cnt == 0 {
+			delete(delta, key)
+		}
+		total += cnt
+	}
+	if total == 0 {
+		return nil
+	}
+	return delta
+}
+
+// 新增数据的过滤条件: 每个segfile中行号大于上一个备份集记录的最大行号的行
+// 写入segfile时独占该文件, 行号在写入前分配, 所以新增的行号总是大于之前已经分配的行号
+func aodeltafilter(delta map[[2]int]int64, pre cmd.AoMetadata) string {
+	prerownum := make(map[[2]int]int64)
+	for _, segfile := range pre.SegFiles {
+		prerownum[[2]int{segfile.SegId, segfile.SegNo}] = segfile.LastRowNum
+	}
+
+	var keys [][2]int
+	for key := range delta {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	var filters []string
+	for _, key := range keys {
+		filters = append(filters, fmt.Sprintf("(gp_segment_id = %d AND %s = %d AND %s > %d)", key[0], aosegnoexpr, key[1], aorownumexpr, prerownum[key]))
+	}
+	return strings.Join(filters, " OR ")
+}
+
+func bkheaptable(dbconn *sql.DB, tabinfo map[string]interface{}) (cmd.HeapMetadata, string, bool, error) {
+	var heapmeta cmd.HeapMetadata
 	dbtx, err := dbconn.Begin()
 	if err != nil {
-		return 0, false, err
+		return heapmeta, "", false, err
 	}
 	defer func() {
 		if err != nil {
@@ -214,117 +440,691 @@ func bkheaptable(dbconn *sql.DB, tabinfo map[string]interface{}) (int, bool, err
 	SET TRANSACTION SNAPSHOT '%s';
 	`, DbSnapShot))
 	if err != nil {
-		return 0, false, err
+		return heapmeta, "", false, err
 	}
 
 	colnameagg := fmt.Sprintf("%v", tabinfo["colnameagg"])
 	tablename := fmt.Sprintf("%v", tabinfo["tablename"])
 	tableoid := fmt.Sprintf("%v", tabinfo["oid"])
+	insertonly, _ := tabinfo["insertonly"].(bool)
 
-	// 获取heap表的maxstat
-	// 1.获取表和toast的relfilenode
-	getrelfilesql := fmt.Sprintf(`
-	select t1.reltablespace, t1.relfilenode, t2.hostname, t2.datadir 
-	from (
-	select gp_segment_id, reltablespace, relfilenode 
-	from pg_class 
-	where oid = %s::oid
-	union 
-    select gp_segment_id, reltablespace, relfilenode 
-	from pg_class 
-	where oid = (
-	select reltoastrelid 
-	from pg_class 
-	where oid = %s::oid)
-	union 
-	select gp_segment_id, reltablespace, relfilenode 
-	from gp_dist_random('pg_class') 
-	where oid = %s::oid
-	union  
-	select gp_segment_id, reltablespace, relfilenode 
-	from gp_dist_random('pg_class') 
-	where oid = (
-	select reltoastrelid 
-	from pg_class 
-	where oid = %s::oid)) t1 
-	join gp_segment_configuration t2 on t1.gp_segment_id = t2.content 
-	and t2.role = 'p'
-	`, tableoid, tableoid, tableoid, tableoid)
-
-	rows, err := dbtx.Query(getrelfilesql)
-	if err != nil {
-		return 0, false, fmt.Errorf("Failed to get heap table file infomation: %s", err.Error())
-	}
-	defer rows.Close()
+	if cmd.ArgConfig.HeapDetector == "counter" {
+		// 使用备份开始前收集的变化信息
+		heapmeta = HeapCounters[tableoid]
+		heapmeta.Detector = "counter"
+	} else if cmd.ArgConfig.HeapDetector == "pgstatfile" {
+		var ok bool
+		heapmeta, ok = HeapStats[tableoid]
+		if !ok {
+			heapmeta.MaxStat = -1
+		}
+		heapmeta.Detector = "pgstatfile"
+	} else {
+		// 获取heap表的maxstat
+		// 1.获取表和toast的relfilenode
+		getrelfilesql := fmt.Sprintf(`
+		select t1.reltablespace, t1.relfilenode, t2.hostname, t2.datadir 
+		from (
+		select gp_segment_id, reltablespace, relfilenode 
+		from pg_class 
+		where oid = %s::oid
+		union 
+	    select gp_segment_id, reltablespace, relfilenode 
+		from pg_class 
+		where oid = (
+		select reltoastrelid 
+		from pg_class 
+		where oid = %s::oid)
+		union 
+		select gp_segment_id, reltablespace, relfilenode 
+		from gp_dist_random('pg_class') 
+		where oid = %s::oid
+		union  
+		select gp_segment_id, reltablespace, relfilenode 
+		from gp_dist_random('pg_class') 
+		where oid = (
+		select reltoastrelid 
+		from pg_class 
+		where oid = %s::oid)) t1 
+		join gp_segment_configuration t2 on t1.gp_segment_id = t2.content 
+		and t2.role = 'p'
+		`, tableoid, tableoid, tableoid, tableoid)
 
-	maxstat := 0
-	var sshcmd []map[string]string
-	for rows.Next() {
-		var tbsid, fileid, host, datadir string
-		err = rows.Scan(&tbsid, &fileid, &host, &datadir)
+		var rows *sql.Rows
+		rows, err = dbtx.Query(getrelfilesql)
 		if err != nil {
-			return 0, false, fmt.Errorf("Failed to get heap table file infomation: %s", err.Error())
+			return heapmeta, "", false, fmt.Errorf("Failed to get heap table file infomation: %s", err.Error())
 		}
+		defer rows.Close()
 
-		var cmdstr string
-		if tbsid != "0" {
-			cmdstr = fmt.Sprintf("stat -c %%Y %s/pg_tblspc/%s/GPDB_7_%s/%d/%s* | sort -n | tail -1", datadir, tbsid, Catavers, DbOid, fileid)
-		} else {
-			cmdstr = fmt.Sprintf("stat -c %%Y %s/base/%d/%s* | sort -n | tail -1", datadir, DbOid, fileid)
-		}
-		sshcmd = append(sshcmd, map[string]string{"host": host, "cmd": cmdstr})
-	}
+		maxstat := 0
+		var sshcmd []map[string]string
+		for rows.Next() {
+			var tbsid, fileid, host, datadir string
+			err = rows.Scan(&tbsid, &fileid, &host, &datadir)
+			if err != nil {
+				return heapmeta, "", false, fmt.Errorf("Failed to get heap table file infomation: %s", err.Error())
+			}
 
-	for _, cmds := range sshcmd {
-		output, err := cmd.SessPool.ExecuteCommand(cmds["host"], cmds["cmd"])
-		if err != nil {
-			return 0, false, fmt.Errorf("Failed to get heap table file infomation: %s", err.Error())
+			var cmdstr string
+			if tbsid != "0" {
+				cmdstr = fmt.Sprintf("stat -c %%Y %s/pg_tblspc/%s/GPDB_7_%s/%d/%s* | sort -n | tail -1", datadir, tbsid, Catavers, DbOid, fileid)
+			} else {
+				cmdstr = fmt.Sprintf("stat -c %%Y %s/base/%d/%s* | sort -n | tail -1", datadir, DbOid, fileid)
+			}
+			sshcmd = append(sshcmd, map[string]string{"host": host, "cmd": cmdstr})
 		}
 
-		stat, err := strconv.Atoi(output)
-		if err != nil {
-			return 0, false, fmt.Errorf("Failed to get heap table file infomation: %s", err.Error())
-		}
+		for _, cmds := range sshcmd {
+			output, err := cmd.SessPool.ExecuteCommand(cmds["host"], cmds["cmd"])
+			if err != nil {
+				return heapmeta, "", false, fmt.Errorf("Failed to get heap table file infomation: %s", err.Error())
+			}
+
+			stat, err := strconv.Atoi(output)
+			if err != nil {
+				return heapmeta, "", false, fmt.Errorf("Failed to get heap table file infomation: %s", err.Error())
+			}
 
-		if stat > maxstat {
-			maxstat = stat
+			if stat > maxstat {
+				maxstat = stat
+			}
 		}
+		heapmeta = cmd.HeapMetadata{Detector: "stat", MaxStat: maxstat}
 	}
 
-	var isbackupable bool
+	// 只插入表使用快照之后收集的统计信息计数判断是否只有插入操作
+	// 获取快照之后才成为只插入表的没有计数, 备份整张表
+	if insertonly {
+		counters := SnapCounters[tableoid]
+		heapmeta.InsTup = counters.InsTup
+		heapmeta.UpdTup = counters.UpdTup
+		heapmeta.DelTup = counters.DelTup
+		heapmeta.ModSinceAnalyze = counters.ModSinceAnalyze
+		heapmeta.FileNode = counters.FileNode
+		heapmeta.DeltaBase = counters.DeltaBase
+	}
+
+	var isbackupable, isdelta bool
+	var reason string
+	premeta, existed := IncrYaml.IncrementalMetadata.Heap[tablename]
 	if BackupType == "full" {
-		isbackupable = true
+		isbackupable, reason = true, ReasonFull
+	} else if CarryTabs[tablename] {
+		isbackupable, reason = true, ReasonCarried
+	} else if !existed {
+		isbackupable, reason = true, ReasonNewTable
 	} else {
-		if maxstat > IncrYaml.IncrementalMetadata.Heap[tablename].MaxStat {
-			isbackupable = true
+		changed := heapchanged(heapmeta, premeta)
+		changedreason := ReasonFileTime
+		if heapmeta.Detector == "counter" {
+			changedreason = ReasonCounters
+		}
+		if changed && !insertonly {
+			isbackupable, reason = true, changedreason
 		} else {
 			var ddlcnt int
 			getddlcnt := fmt.Sprintf("select count(*) from logddl.ddl_log where object_name = '%s' and timestamp < to_timestamp('%s', 'YYYYMMDDHH24MISSMS')", tablename, Timestamp)
 			err := dbtx.QueryRow(getddlcnt).Scan(&ddlcnt)
 			if err != nil {
-				return 0, false, fmt.Errorf("Failed to get heap table ddl infomation: %s", err.Error())
+				return heapmeta, "", false, fmt.Errorf("Failed to get heap table ddl infomation: %s", err.Error())
 			}
-			if ddlcnt > 0 {
+			if changed {
+				// 只插入表没有DDL并且只有插入操作, 只备份新增的数据, 否则备份整张表
+				isbackupable, reason = true, changedreason
+				isdelta = ddlcnt == 0 && insertsonly(heapmeta, premeta)
+				if isdelta {
+					reason = ReasonInserted
+				}
+			} else if ddlcnt > 0 {
 				// 如果表DDL发生变化，则备份
-				isbackupable = true
+				isbackupable, reason = true, ReasonDDLLog
 			} else {
 				isbackupable = false
-				return maxstat, false, nil
+				return heapmeta, ReasonUnchanged, false, nil
 			}
 		}
 	}
 
-	if isbackupable {
+	if _, ok := reusable(tablename, reason, heapmeta); ok && isbackupable {
+		cmd.LogInfoFields(cmd.LogFields{Table: tablename}, "Heap table %s unchanged since the interrupted backup, reusing uploaded data", tablename)
+		return heapmeta, reason, true, nil
+	}
+
+	if isbackupable && !cmd.ArgConfig.DryRun {
 		copysql := fmt.Sprintf(`
-		COPY %s(%s) TO PROGRAM 'gzip -c -1 | %s/bin/gpbackup_s3_plugin backup_data /tmp/gpdbbr_%s_s3.yaml <SEG_DATA_DIR>/backups/%s/%s/gpdbbr_<SEGID>_%s_%s.gz' WITH CSV DELIMITER ',' ON SEGMENT IGNORE EXTERNAL PARTITIONS;
-		`, tablename, colnameagg, GpHome, Timestamp, BackupDate, Timestamp, Timestamp, tableoid)
+		COPY %s(%s) TO PROGRAM '%s' WITH CSV DELIMITER ',' ON SEGMENT IGNORE EXTERNAL PARTITIONS;
+		`, tablename, colnameagg, copyprogram(tableoid, tablename))
+		if isdelta {
+			copysql = fmt.Sprintf(`
+			COPY (SELECT %s FROM %s WHERE %s) TO PROGRAM '%s' WITH CSV DELIMITER ',' ON SEGMENT;
+			`, colnameagg, tablename, deltafilter(), copyprogram(tableoid, tablename))
+		}
 		timestart := time.Now()
 		_, err = dbtx.Exec(copysql)
 		if err != nil {
-			return 0, false, fmt.Errorf("Failed to execute heap table backup sql: %s", err.Error())
+			return heapmeta, "", false, fmt.Errorf("Failed to execute heap table backup sql: %s", err.Error())
 		}
 		duration := time.Since(timestart).Seconds()
-		cmd.LogInfo("Backup heap table done: %s, duration: %.2fs", tablename, duration)
+		if isdelta {
+			cmd.LogInfoFields(cmd.LogFields{Table: tablename, Duration: duration}, "Backup heap table new rows done: %s, duration: %.2fs", tablename, duration)
+		} else {
+			cmd.LogInfoFields(cmd.LogFields{Table: tablename, Duration: duration}, "Backup heap table done: %s, duration: %.2fs", tablename, duration)
+		}
+	}
+	return heapmeta, reason, true, nil
+}
+
+// 只插入表自上一个备份集之后是否只有插入操作
+func insertsonly(cur cmd.HeapMetadata, pre cmd.HeapMetadata) bool {
+	if !pre.DeltaBase || pre.FileNode == 0 || len(IncrYaml.SegSnapshots) == 0 || len(IncrYaml.SegSnapshots) != len(BkResult.SegSnapshots) {
+		return false
+	}
+	return cur.FileNode == pre.FileNode && cur.UpdTup == pre.UpdTup && cur.DelTup == pre.DelTup && cur.InsTup >= pre.InsTup
+}
+
+// 新增数据的过滤条件: 上一个备份集的segment本地快照中不可见的行
+func deltafilter() string {
+	// xmin是32位的事务号, 使用当前快照的epoch转换为64位
+	xid := "((txid_snapshot_xmax(txid_current_snapshot()) >> 32 << 32) + xmin::text::bigint)"
+	xid64 := fmt.Sprintf("(CASE WHEN %s > txid_snapshot_xmax(txid_current_snapshot()) THEN %s - 4294967296 ELSE %s END)", xid, xid, xid)
+
+	var segids []int
+	for segid := range IncrYaml.SegSnapshots {
+		segids = append(segids, segid)
+	}
+	sort.Ints(segids)
+
+	var cases []string
+	for _, segid := range segids {
+		cases = append(cases, fmt.Sprintf("WHEN %d THEN '%s'::txid_snapshot", segid, IncrYaml.SegSnapshots[segid]))
+	}
+	return fmt.Sprintf("NOT txid_visible_in_snapshot(%s, CASE gp_segment_id %s END)", xid64, strings.Join(cases, " "))
+}
+
+// 获取只插入表, oid -> 表名
+func getinsertonly(dbconn *sql.DB) map[string]string {
+	rows, err := dbconn.Query(`
+	SELECT c.oid::text, quote_ident(n.nspname)||'.'||quote_ident(c.relname)
+	FROM pg_class c
+	JOIN pg_namespace n ON c.relnamespace = n.oid
+	WHERE c.relkind = 'r'
+	AND n.nspname NOT LIKE 'pg_temp_%'
+	AND n.nspname NOT LIKE 'pg_toast%'
+	AND n.nspname NOT IN ('gp_toolkit', 'information_schema', 'pg_aoseg', 'pg_bitmapindex', 'pg_catalog', 'logddl')
+	AND (` + insertonlysql() + `)
+	` + cmd.FilterSql(cmd.ArgConfig.Filter, "n.nspname", "c.relname"))
+	if err != nil {
+		cmd.LogError("Failed to get insert-only tables: %s", err.Error())
+		cmd.Exit(1)
+	}
+	defer rows.Close()
+
+	tables := make(map[string]string)
+	for rows.Next() {
+		var oid, tablename string
+		if err := rows.Scan(&oid, &tablename); err != nil {
+			cmd.LogError("Failed to get insert-only tables: %s", err.Error())
+			cmd.Exit(1)
+		}
+		tables[oid] = tablename
+	}
+	return tables
+}
+
+// 以SHARE模式锁定只插入表, 等待正在写入的事务结束并阻止新的写入, 提交事务后释放
+// 超时没有获取到锁时返回nil, 这些表在下一次备份中备份整张表
+func lockinsertonly(dbconn *sql.DB, tables map[string]string) *sql.Tx {
+	var names []string
+	for _, tablename := range tables {
+		names = append(names, tablename)
+	}
+	sort.Strings(names)
+
+	locktx, err := dbconn.Begin()
+	if err != nil {
+		cmd.LogError("Failed to begin transaction: %s", err.Error())
+		cmd.Exit(1)
+	}
+	_, err = locktx.Exec(fmt.Sprintf(`
+	SET LOCAL lock_timeout = '%s';
+	LOCK TABLE %s IN SHARE MODE COORDINATOR ONLY;
+	`, insertOnlyLockTimeout, strings.Join(names, ", ")))
+	if err != nil {
+		_ = locktx.Rollback()
+		cmd.LogInfo("Could not lock insert-only tables within %s, they will be fully backed up next time: %s", insertOnlyLockTimeout, err.Error())
+		return nil
+	}
+	return locktx
+}
+
+// 判断表是否为只插入表的sql表达式
+func insertonlysql() string {
+	sqlstr := "COALESCE(obj_description(c.oid, 'pg_class'), '') LIKE '%gpdbbr:insert-only%'"
+	if len(cmd.ArgConfig.InsertOnly) > 0 {
+		sqlstr += fmt.Sprintf(" OR n.nspname||'.'||c.relname IN (%s)", cmd.QuoteLiterals(cmd.ArgConfig.InsertOnly))
+	}
+	return sqlstr
+}
+
+// 任务开始时输出最近一次成功的备份, 本次备份失败时指标仍然有值
+func putlastsuccess() {
+	if !cmd.MetricsEnabled() {
+		return
+	}
+	s3client := cmd.CreS3Client()
+	sets, err := cmd.ListBkSets(s3client)
+	if err != nil {
+		cmd.LogError("Failed to list backup sets for metrics: %s", err.Error())
+		return
+	}
+	for i := len(sets) - 1; i >= 0; i-- {
+		bkmeta, err := cmd.GetBkMeta(s3client, sets[i])
+		if err != nil {
+			if cmd.IsNoSuchKey(err) {
+				continue
+			}
+			cmd.LogError("Failed to read backup metadata file for metrics: %s", err.Error())
+			return
+		}
+		if bkmeta.JobInfo.Status == "success" {
+			cmd.SetSetTimeMetric("gpdbbr_last_successful_backup", "Timestamp of the last successful backup", sets[i].Time)
+			return
+		}
+	}
+}
+
+// 输出备份的监控指标
+func putmetrics() {
+	cmd.SetMetric("gpdbbr_backup_tables", "Tables handled by the backup", map[string]string{"status": "backed_up"}, float64(len(BkResult.DataEntries)))
+	cmd.SetMetric("gpdbbr_backup_tables", "Tables handled by the backup", map[string]string{"status": "failed"}, float64(len(BkResult.FailTables)))
+	cmd.SetMetric("gpdbbr_backup_tables", "Tables handled by the backup", map[string]string{"status": "carried"}, float64(len(BkResult.CarriedTables)))
+	cmd.SetMetric("gpdbbr_backup_tables", "Tables handled by the backup", map[string]string{"status": "checked"}, float64(len(Plan)))
+
+	var total int64
+	for _, entry := range BkResult.DataEntries {
+		var size int64
+		for _, object := range entry.Objects {
+			size += object.Size
+		}
+		total += size
+		cmd.SetMetric("gpdbbr_backup_table_bytes", "Bytes written to s3 per table", map[string]string{"table": entry.TableName}, float64(size))
+	}
+	cmd.SetMetric("gpdbbr_backup_bytes", "Bytes of table data written to s3", nil, float64(total))
+
+	if BkResult.JobInfo.Status == "success" {
+		cmd.SetSetTimeMetric("gpdbbr_last_successful_backup", "Timestamp of the last successful backup", Timestamp)
+	} else {
+		cmd.SetJobSuccess(false)
+	}
+}
+
+// 打印备份计划
+func printplan() {
+	sort.Slice(Plan, func(i, j int) bool { return Plan[i].TableName < Plan[j].TableName })
+
+	if cmd.ArgConfig.Json {
+		data, err := json.MarshalIndent(Plan, "", "  ")
+		if err != nil {
+			cmd.LogError("Failed to marshal backup plan: %s", err.Error())
+			cmd.Exit(1)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	var backupcnt int
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "TABLE\tKIND\tDECISION\tREASON")
+	for _, item := range Plan {
+		decision := "skip"
+		if item.Backup {
+			decision = "backup"
+			backupcnt++
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", item.TableName, item.Kind, decision, item.Reason)
+	}
+	writer.Flush()
+	cmd.LogInfo("Dry run of %s backup: %d of %d tables would be backed up, nothing was written", BackupType, backupcnt, len(Plan))
+}
+
+// 记录每个数据项在各segment上传的文件, 文件数量和segment数量不一致的表视为备份失败
+func fillobjects() {
+	set := cmd.BkSet{Date: BackupDate, Time: Timestamp}
+	setobjects, err := cmd.ListDataObjects(cmd.CreS3Client(), set)
+	if err != nil {
+		cmd.LogError("Failed to list backup set objects(%s): %s", cmd.BkSetPrefix(set), err.Error())
+		cmd.Exit(1)
+	}
+
+	var entries []cmd.DataEntry
+	for _, entry := range BkResult.DataEntries {
+		entry.Objects = setobjects[entry.FileId()]
+		if len(entry.Objects) != len(BkResult.SegSnapshots) {
+			cmd.LogError("Backup table %s failed: %d of %d segment data files uploaded", entry.TableName, len(entry.Objects), len(BkResult.SegSnapshots))
+			BkResult.FailTables = append(BkResult.FailTables, entry.TableName)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	BkResult.DataEntries = entries
+}
+
+// 备份数据的COPY程序, 压缩加密后通过s3插件上传到segment的数据目录下
+func copyprogram(fileid string, tablename string) string {
+	codec := cmd.TableCompression(tablename)
+	return fmt.Sprintf("%s%s%s%s/bin/gpbackup_s3_plugin backup_data /tmp/gpdbbr_%s_s3.yaml <SEG_DATA_DIR>/backups/%s/%s/%s",
+		cmd.CompressPipe(codec), cmd.EncryptPipe(Timestamp), cmd.S3PluginEnv(Timestamp), GpHome, Timestamp, BackupDate, Timestamp, cmd.DataFileName("<SEGID>", Timestamp, fileid, codec))
+}
+
+// 判断heap表是否发生变化, 检测方式变化时视为发生变化
+func heapchanged(cur cmd.HeapMetadata, pre cmd.HeapMetadata) bool {
+	if pre.Detector == "" {
+		pre.Detector = "stat"
+	}
+	if cur.Detector != pre.Detector {
+		return true
+	}
+
+	if cur.Detector == "counter" {
+		// 计数减少表示统计信息被重置, 也视为发生变化
+		return cur.InsTup != pre.InsTup || cur.UpdTup != pre.UpdTup || cur.DelTup != pre.DelTup ||
+			cur.ModSinceAnalyze > pre.ModSinceAnalyze || cur.FileNode != pre.FileNode
+	}
+	// stat和pgstatfile都比较文件的最大修改时间, 无法获取修改时间(-1)时视为发生变化
+	return cur.MaxStat < 0 || cur.MaxStat > pre.MaxStat
+}
+
+// 收集所有表在segment上的统计信息计数, oid -> 元数据
+func getheapcounters(dbconn *sql.DB) map[string]cmd.HeapMetadata {
+	counters := make(map[string]cmd.HeapMetadata)
+	rows, err := dbconn.Query(`
+	SELECT c.oid::text AS oid,
+	COALESCE(SUM(pg_stat_get_tuples_inserted(c.oid)), 0)::bigint AS instup,
+	COALESCE(SUM(pg_stat_get_tuples_updated(c.oid)), 0)::bigint AS updtup,
+	COALESCE(SUM(pg_stat_get_tuples_deleted(c.oid)), 0)::bigint AS deltup,
+	COALESCE(SUM(pg_stat_get_mod_since_analyze(c.oid)), 0)::bigint AS modsinceanalyze,
+	SUM(c.relfilenode::bigint)::bigint AS filenode
+	FROM gp_dist_random('pg_class') c
+	WHERE c.relkind = 'r'
+	AND c.oid >= 16384
+	GROUP BY c.oid
+	`)
+	if err != nil {
+		cmd.LogError("Failed to get heap table statistics counters: %s", err.Error())
+		cmd.Exit(1)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid string
+		var heapmeta cmd.HeapMetadata
+		err = rows.Scan(&oid, &heapmeta.InsTup, &heapmeta.UpdTup, &heapmeta.DelTup, &heapmeta.ModSinceAnalyze, &heapmeta.FileNode)
+		if err != nil {
+			cmd.LogError("Failed to get heap table statistics counters: %s", err.Error())
+			cmd.Exit(1)
+		}
+		counters[oid] = heapmeta
+	}
+	return counters
+}
+
+// 备份的数据项, 沿用中断前上传的数据文件时使用原来的数据项
+func newentry(table map[string]interface{}, reason string, meta interface{}) cmd.DataEntry {
+	tabname := table["tablename"].(string)
+	if entry, ok := reusable(tabname, reason, meta); ok {
+		return entry
+	}
+	return cmd.DataEntry{
+		TableName:       tabname,
+		OID:             table["oid"].(string),
+		AttributeString: table["colnameagg"].(string),
+		Delta:           reason == ReasonAppended || reason == ReasonInserted,
+		Compression:     cmd.TableCompression(tabname),
+		Encrypted:       len(cmd.CryptKey) > 0,
+		Reason:          reason,
+	}
+}
+
+// 快照失效后继续备份, 表的元数据和中断前完成时相同并且备份方式相同时, 中断前上传的数据和新的快照一致
+func reusable(tabname string, reason string, meta interface{}) (cmd.DataEntry, bool) {
+	entry, ok := ReuseEntries[tabname]
+	if !ok || entry.Reason != reason || entry.Compression != cmd.TableCompression(tabname) || entry.Encrypted != (len(cmd.CryptKey) > 0) {
+		return entry, false
+	}
+	var pre interface{}
+	switch meta.(type) {
+	case cmd.AoMetadata:
+		pre, ok = ReuseMeta.AO[tabname]
+	case cmd.HeapMetadata:
+		pre, ok = ReuseMeta.Heap[tabname]
+	}
+	return entry, ok && reflect.DeepEqual(meta, pre)
+}
+
+// 通过pg_stat_file收集所有表在segment上的数据文件最大修改时间
+// 文件路径和修改时间在gp_dist_random的同一层计算, 保证在各segment上执行
+// 无法获取修改时间的表记为-1, 视为发生变化
+func getheapfilestats(dbconn *sql.DB) {
+	// 各segment上表对应的toast表
+	rows, err := dbconn.Query(`
+	SELECT c.gp_segment_id, c.oid::text, COALESCE(t.oid, 0)::text
+	FROM gp_dist_random('pg_class') c
+	LEFT JOIN gp_dist_random('pg_class') t
+	ON c.reltoastrelid = t.oid AND c.gp_segment_id = t.gp_segment_id
+	WHERE c.relkind = 'r'
+	AND c.oid >= 16384
+	`)
+	if err != nil {
+		cmd.LogError("Failed to get heap table file infomation: %s", err.Error())
+		cmd.Exit(1)
+	}
+	defer rows.Close()
+
+	type relfile struct {
+		segid   int
+		oid     string
+		toastid string
+	}
+	var relfiles []relfile
+	for rows.Next() {
+		var rf relfile
+		err = rows.Scan(&rf.segid, &rf.oid, &rf.toastid)
+		if err != nil {
+			cmd.LogError("Failed to get heap table file infomation: %s", err.Error())
+			cmd.Exit(1)
+		}
+		relfiles = append(relfiles, rf)
+	}
+	rows.Close()
+
+	// 各segment上表和toast表每个数据文件 relfilenode[.N] 的修改时间, segid -> oid -> 最大修改时间, 文件不存在时为-1
+	rows, err = dbconn.Query(`
+	SELECT gp_segment_id, oid::text,
+	EXTRACT(EPOCH FROM (pg_stat_file(pg_relation_filepath(oid)
+	|| regexp_replace('.' || generate_series(0, (pg_relation_size(oid) / 1073741824)::int), '^\.0$', ''), true)).modification)::bigint
+	FROM gp_dist_random('pg_class')
+	WHERE relkind IN ('r', 't')
+	AND oid >= 16384
+	`)
+	if err != nil {
+		cmd.LogError("Failed to get heap table file modification time: %s", err.Error())
+		cmd.Exit(1)
+	}
+	filestats := make(map[int]map[string]int)
+	for rows.Next() {
+		var segid int
+		var oid string
+		var modtime sql.NullInt64
+		err = rows.Scan(&segid, &oid, &modtime)
+		if err != nil {
+			cmd.LogError("Failed to get heap table file modification time: %s", err.Error())
+			cmd.Exit(1)
+		}
+		mtime := -1
+		if modtime.Valid {
+			mtime = int(modtime.Int64)
+		}
+		if filestats[segid] == nil {
+			filestats[segid] = make(map[string]int)
+		}
+		if pre, ok := filestats[segid][oid]; !ok || (pre >= 0 && (mtime < 0 || mtime > pre)) {
+			filestats[segid][oid] = mtime
+		}
+	}
+	rows.Close()
+
+	HeapStats = make(map[string]cmd.HeapMetadata)
+	for _, rf := range relfiles {
+		heapmeta := HeapStats[rf.oid]
+		for _, oid := range []string{rf.oid, rf.toastid} {
+			if oid == "0" || heapmeta.MaxStat < 0 {
+				continue
+			}
+			mtime, ok := filestats[rf.segid][oid]
+			if !ok || mtime < 0 {
+				heapmeta.MaxStat = -1
+			} else if mtime > heapmeta.MaxStat {
+				heapmeta.MaxStat = mtime
+			}
+		}
+		HeapStats[rf.oid] = heapmeta
+	}
+}
+
+// 读取中断备份的进度
+func getprogress() {
+	s3client := cmd.CreS3Client()
+	ResumeSet = cmd.BkSet{Date: cmd.ArgConfig.Resume[:8], Time: cmd.ArgConfig.Resume}
+
+	_, err := cmd.GetBkMeta(s3client, ResumeSet)
+	if err == nil {
+		cmd.LogError("Backup %s already completed, nothing to resume", ResumeSet.Time)
+		cmd.Exit(1)
+	} else if !cmd.IsNoSuchKey(err) {
+		cmd.LogError("Failed to get backup metadata file(%s): %s", cmd.BkSetMetaFile(ResumeSet), err.Error())
+		cmd.Exit(1)
+	}
+
+	var progress cmd.BkProgress
+	err = cmd.GetS3Yaml(s3client, cmd.BkSetProgressFile(ResumeSet), &progress)
+	if err != nil {
+		if cmd.IsNoSuchKey(err) {
+			cmd.LogInfo("No progress found for backup %s, restarting cleanly", ResumeSet.Time)
+			removeresume()
+			return
+		}
+		cmd.LogError("Failed to get backup progress file(%s): %s", cmd.BkSetProgressFile(ResumeSet), err.Error())
+		cmd.Exit(1)
+	}
+
+	// 中断之后已经有新的备份, 或者备份类型不一致, 不能继续
+	if BaseTime >= ResumeSet.Time || progress.BackupType != BackupType {
+		cmd.LogInfo("Backup %s can not be resumed on the current backup chain, restarting cleanly", ResumeSet.Time)
+		removeresume()
+		return
+	}
+
+	// 已经上传的数据使用原来的密钥加密, 继续使用相同的密钥
+	if err := cmd.UseKeySalt(progress.KeySalt); err != nil {
+		cmd.LogError("Failed to derive encryption key of backup %s: %s", ResumeSet.Time, err.Error())
+		cmd.Exit(1)
+	}
+	Progress = &progress
+}
+
+// 判断快照是否还存在
+func checksnapshot(dbconn *sql.DB, snapshot string) bool {
+	dbtx, err := dbconn.Begin()
+	if err != nil {
+		return false
+	}
+	defer dbtx.Rollback()
+
+	_, err = dbtx.Exec(fmt.Sprintf(`
+	SET TRANSACTION ISOLATION LEVEL SERIALIZABLE;
+	SET TRANSACTION SNAPSHOT '%s';
+	`, snapshot))
+	return err == nil
+}
+
+// 删除中断的备份集, 重新开始备份
+func removeresume() {
+	cmd.LogInfo("Removing interrupted backup %s", ResumeSet.Time)
+	if err := cmd.RemoveS3Prefix(cmd.CreS3Client(), cmd.BkSetPrefix(ResumeSet)); err != nil {
+		cmd.LogError("Failed to remove interrupted backup %s: %s", ResumeSet.Time, err.Error())
+		cmd.Exit(1)
+	}
+	Progress = nil
+}
+
+// 启动后台写入备份进度的协程, 写入期间的多次通知合并为一次写入
+func startprogress() {
+	ProgressCh = make(chan struct{}, 1)
+	ProgressDone = make(chan struct{})
+	go func() {
+		defer close(ProgressDone)
+		defer cmd.Recover()
+		for range ProgressCh {
+			writeprogress()
+		}
+	}()
+}
+
+// 等待最后一次备份进度写入完成
+func stopprogress() {
+	close(ProgressCh)
+	<-ProgressDone
+}
+
+// 通知后台写入备份进度, 调用时需持有ResultMu; 没有复制数据的表最多每10秒写一次
+func saveprogress(force bool) {
+	if cmd.ArgConfig.DryRun {
+		return
+	}
+	if !force && time.Since(LastSave) < 10*time.Second {
+		return
+	}
+	LastSave = time.Now()
+	select {
+	case ProgressCh <- struct{}{}:
+	default:
+	}
+}
+
+// 持有ResultMu生成备份进度, 释放之后再上传到s3
+func writeprogress() {
+	ResultMu.Lock()
+	progress := cmd.BkProgress{
+		SnapShot:            DbSnapShot,
+		UnixTime:            UnixTime,
+		BackupType:          BackupType,
+		UpdateTime:          time.Now().Format("20060102150405000"),
+		DataEntries:         BkResult.DataEntries,
+		DdlSqls:             BkResult.DdlSqls,
+		IncrementalMetadata: BkResult.IncrementalMetadata,
+		SegSnapshots:        BkResult.SegSnapshots,
+		KeySalt:             cmd.KeySalt(),
+		HeapCounters:        HeapCounters,
+		HeapStats:           HeapStats,
+		SnapCounters:        SnapCounters,
+	}
+	yamldata, err := yaml.Marshal(&progress)
+	ResultMu.Unlock()
+	if err != nil {
+		cmd.LogError("Failed to marshal backup progress: %s", err.Error())
+		return
+	}
+
+	// 写入进度失败不影响备份
+	yamldata, err = cmd.EncryptBytes(yamldata)
+	if err != nil {
+		cmd.LogError("Failed to encrypt backup progress: %s", err.Error())
+		return
+	}
+	set := cmd.BkSet{Date: BackupDate, Time: Timestamp}
+	_, err = cmd.CreS3Client().PutObject(context.Background(), cmd.ArgConfig.S3Bucket, cmd.BkSetProgressFile(set), bytes.NewReader(yamldata), int64(len(yamldata)), minio.PutObjectOptions{ContentType: "application/octest-stream"})
+	if err != nil {
+		cmd.LogError("Failed to write backup progress: %s", err.Error())
 	}
-	return maxstat, true, nil
 }
@@ -1,17 +1,62 @@
 package backup
 
-import "gpdbbr/cmd"
+import (
+	"gpdbbr/cmd"
+	"sync"
+	"time"
+)
+
+// 表是否备份的原因
+const (
+	ReasonFull      = "full"
+	ReasonCarried   = "failed in previous backup"
+	ReasonNewTable  = "new table"
+	ReasonUnchanged = "unchanged"
+	ReasonModCount  = "modcount changed"
+	ReasonAppended  = "appended rows only"
+	ReasonDDLReplay = "DDL replay only"
+	ReasonDDLTime   = "last DDL time changed"
+	ReasonFileTime  = "file time changed"
+	ReasonCounters  = "statistics counters changed"
+	ReasonInserted  = "inserted rows only"
+	ReasonDDLLog    = "DDL recorded"
+)
+
+// 获取快照时等待只插入表锁的最长时间
+const insertOnlyLockTimeout = "30s"
+
+// 备份计划中的一张表
+type PlanItem struct {
+	TableName string `json:"table"`
+	Kind      string `json:"kind"`
+	Backup    bool   `json:"backup"`
+	Reason    string `json:"reason"`
+}
 
 var (
-	BackupType string         // 备份类型
-	Catavers   string         // catalog 版本号码
-	DbSnapShot string         // 数据库快照号
-	UnixTime   string         // 备份的unix时间戳
-	Timestamp  string         // 备份时间戳
-	BackupDate string         // 备份日期
-	GpHome     string         // GP 主目录
-	HostList   []string       // 主机列表
-	DbOid      int            // 数据库 OID
-	IncrYaml   cmd.BkMetaData // 增量备份元数据
-	BkResult   cmd.BkMetaData // 备份结果
+	BackupType   string                      // 备份类型
+	Catavers     string                      // catalog 版本号码
+	DbSnapShot   string                      // 数据库快照号
+	UnixTime     string                      // 备份的unix时间戳
+	Timestamp    string                      // 备份时间戳
+	BackupDate   string                      // 备份日期
+	GpHome       string                      // GP 主目录
+	HostList     []string                    // 主机列表
+	DbOid        int                         // 数据库 OID
+	IncrYaml     cmd.BkMetaData              // 增量备份元数据
+	BkResult     cmd.BkMetaData              // 备份结果
+	CarryTabs    map[string]bool             // 上一次备份失败, 需要强制备份的表
+	BaseTime     string                      // 增量备份基于的备份集时间戳
+	Progress     *cmd.BkProgress             // 断点续传的备份进度
+	ResumeSet    cmd.BkSet                   // 断点续传的备份集
+	ReuseEntries map[string]cmd.DataEntry    // 快照失效后继续备份时, 中断前已经上传的数据项, 表名 -> 数据项
+	ReuseMeta    cmd.IncrementalMetadata     // 快照失效后继续备份时, 中断前完成的表的元数据
+	ResultMu     sync.Mutex                  // 备份结果锁
+	LastSave     time.Time                   // 上一次通知写入备份进度的时间
+	ProgressCh   chan struct{}               // 通知后台写入备份进度
+	ProgressDone chan struct{}               // 后台写入备份进度结束
+	HeapStats    map[string]cmd.HeapMetadata // 备份开始前收集的heap表文件修改时间, oid -> 元数据
+	HeapCounters map[string]cmd.HeapMetadata // 备份开始前收集的heap表统计信息计数, oid -> 元数据
+	SnapCounters map[string]cmd.HeapMetadata // 获取快照之后收集的只插入表统计信息计数, oid -> 元数据
+	Plan         []PlanItem                  // 每张表的备份决定
 )
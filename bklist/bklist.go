@@ -0,0 +1,127 @@
+package bklist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gpdbbr/cmd"
+	"os"
+	"text/tabwriter"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func DoList() {
+	cmd.LogInfo("Listing backup sets in %s/%s/backups/", cmd.ArgConfig.S3Bucket, cmd.ArgConfig.S3Folder)
+
+	s3client := cmd.CreS3Client()
+	sets, err := cmd.ListBkSets(s3client)
+	if err != nil {
+		cmd.LogError("Failed to list backup sets: %s", err.Error())
+		cmd.Exit(1)
+	}
+
+	for i, set := range sets {
+		SetInfos = append(SetInfos, getsetinfo(s3client, set, i == 0))
+	}
+
+	if cmd.ArgConfig.Json {
+		printjson()
+	} else {
+		printtable()
+	}
+
+	// 最新的成功备份
+	for i := len(SetInfos) - 1; i >= 0; i-- {
+		if SetInfos[i].Status == "success" {
+			cmd.SetSetTimeMetric("gpdbbr_last_successful_backup", "Timestamp of the last successful backup", SetInfos[i].Timestamp)
+			break
+		}
+	}
+	cmd.SetMetric("gpdbbr_backup_sets", "Backup sets in s3", nil, float64(len(SetInfos)))
+}
+
+// 获取单个备份集的信息
+func getsetinfo(s3client *minio.Client, set cmd.BkSet, isfirst bool) BkSetInfo {
+	setinfo := BkSetInfo{
+		Timestamp:  set.Time,
+		Date:       set.Date,
+		FailTables: []string{},
+	}
+
+	// 统计备份集的对象大小
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    cmd.BkSetPrefix(set),
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			cmd.LogError("Failed to list backup set objects(%s): %s", cmd.BkSetPrefix(set), object.Err.Error())
+			cmd.Exit(1)
+		}
+		setinfo.TotalBytes += object.Size
+	}
+
+	bkmeta, err := cmd.GetBkMeta(s3client, set)
+	if err != nil {
+		if cmd.IsNoSuchKey(err) {
+			// 没有jobinfo文件, 表示备份没有完成
+			setinfo.Status = "incomplete"
+			return setinfo
+		}
+		cmd.LogError("Failed to read backup metadata file(%s): %s", cmd.BkSetMetaFile(set), err.Error())
+		cmd.Exit(1)
+	}
+
+	setinfo.Status = bkmeta.JobInfo.Status
+	setinfo.BeginTime = bkmeta.JobInfo.BeginTime
+	setinfo.EndTime = bkmeta.JobInfo.EndTime
+	setinfo.DataEntries = len(bkmeta.DataEntries)
+	setinfo.DdlSqls = len(bkmeta.DdlSqls)
+	if bkmeta.FailTables != nil {
+		setinfo.FailTables = bkmeta.FailTables
+	}
+
+	setinfo.BackupType = cmd.GetBkType(bkmeta, isfirst)
+	setinfo.ChainId = bkmeta.JobInfo.ChainId
+
+	return setinfo
+}
+
+func printjson() {
+	if SetInfos == nil {
+		SetInfos = []BkSetInfo{}
+	}
+	jsondata, err := json.MarshalIndent(SetInfos, "", "  ")
+	if err != nil {
+		cmd.LogError("Failed to marshal backup sets to json: %s", err.Error())
+		cmd.Exit(1)
+	}
+	fmt.Println(string(jsondata))
+}
+
+func printtable() {
+	if len(SetInfos) == 0 {
+		cmd.LogInfo("No backup found")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIMESTAMP\tTYPE\tCHAIN\tSTATUS\tBEGINTIME\tENDTIME\tDATAENTRIES\tDDLS\tFAILTABLES\tBYTES")
+	for _, setinfo := range SetInfos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n", setinfo.Timestamp, setinfo.BackupType, setinfo.ChainId, setinfo.Status,
+			setinfo.BeginTime, setinfo.EndTime, setinfo.DataEntries, setinfo.DdlSqls, len(setinfo.FailTables), setinfo.TotalBytes)
+	}
+	tw.Flush()
+
+	// 最新的成功备份
+	for i := len(SetInfos) - 1; i >= 0; i-- {
+		if SetInfos[i].Status == "success" {
+			cmd.LogInfo("Latest successful backup = %s", SetInfos[i].Timestamp)
+			return
+		}
+	}
+	cmd.LogInfo("No successful backup found")
+}
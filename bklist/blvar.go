@@ -0,0 +1,20 @@
+package bklist
+
+// 备份集信息
+type BkSetInfo struct {
+	Timestamp   string   `json:"timestamp"`
+	Date        string   `json:"date"`
+	BackupType  string   `json:"backuptype"`
+	ChainId     string   `json:"chainid"`
+	Status      string   `json:"status"`
+	BeginTime   string   `json:"begintime"`
+	EndTime     string   `json:"endtime"`
+	DataEntries int      `json:"dataentries"`
+	DdlSqls     int      `json:"ddlsqls"`
+	FailTables  []string `json:"failtables"`
+	TotalBytes  int64    `json:"totalbytes"`
+}
+
+var (
+	SetInfos []BkSetInfo // 备份集列表
+)
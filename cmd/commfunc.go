@@ -3,32 +3,45 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"gopkg.in/yaml.v3"
 )
 
 // 自定义日志函数
 func LogInfo(format string, v ...interface{}) {
-	logWithTag("INFO", format, v...)
+	logWithTag("INFO", LogFields{}, format, v...)
 }
 
 func LogError(format string, v ...interface{}) {
-	logWithTag("ERROR", format, v...)
+	logWithTag("ERROR", LogFields{}, format, v...)
 }
 
 // 通用的日志打印函数
-func logWithTag(tag string, format string, v ...interface{}) {
+func logWithTag(tag string, fields LogFields, format string, v ...interface{}) {
 	// 获取当前时间，格式化为 yyyymmdd hh24:mi:ss
 	timestamp := time.Now().Format("20060102 15:04:05")
 
@@ -37,6 +50,7 @@ func logWithTag(tag string, format string, v ...interface{}) {
 
 	// 如果是 ERROR 日志，获取调用栈信息
 	if tag == "ERROR" {
+		setlasterror(message)
 		// 获取调用栈信息
 		_, file, line, ok := runtime.Caller(2) // 2 表示跳过两层调用栈（logWithTag 和 LogError）
 		if ok {
@@ -44,19 +58,83 @@ func logWithTag(tag string, format string, v ...interface{}) {
 		}
 	}
 
-	// 打印日志
-	fmt.Printf("%s gpdbbr [%s]:- %s\n", timestamp, tag, message)
+	// 打印日志, json输出时日志写入标准错误, 避免污染标准输出
+	out := os.Stdout
+	if ArgConfig.Json {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "%s gpdbbr [%s]:- %s\n", timestamp, tag, message)
+
+	// json日志
+	writejsonlog(tag, fields, message)
 }
 
-// 创建本地数据库连接
+// 退出时执行的函数, 按注册的相反顺序执行
+var (
+	exitMu    sync.Mutex
+	exitHooks []func(code int)
+	exitOnce  sync.Once
+)
+
+// 注册退出时执行的函数, 用于异常退出时输出指标、发送通知
+func OnExit(hook func(code int)) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitHooks = append(exitHooks, hook)
+}
+
+// 执行退出函数后退出, 退出函数中不能再调用Exit
+func Exit(code int) {
+	exitOnce.Do(func() {
+		exitMu.Lock()
+		hooks := exitHooks
+		exitMu.Unlock()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			hooks[i](code)
+		}
+	})
+	os.Exit(code)
+}
+
+// 收到中断信号时执行退出函数, 删除主机上的配置文件、释放备份锁
+func HandleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-sigs
+		LogError("Received signal %s, exiting", sig)
+		Exit(1)
+	}()
+}
+
+// 捕获异常后执行退出函数, goroutine中的异常不会被main捕获, 需要在每个goroutine中defer调用
+func Recover() {
+	if err := recover(); err != nil {
+		LogError("panic: %v\n%s", err, debug.Stack())
+		Exit(1)
+	}
+}
+
+// 数据库连接串, 密码由驱动从PGPASSWORD或.pgpass读取
+func DbConnInfo(dbname string) string {
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return fmt.Sprintf("host='%s' port=%d user='%s' dbname='%s' sslmode='%s'",
+		quote.Replace(ArgConfig.DbHost), ArgConfig.DbPort, quote.Replace(ArgConfig.DbUser), quote.Replace(dbname), quote.Replace(ArgConfig.DbSSLMode))
+}
+
+// pg_dump的连接参数, 和数据复制连接同一个数据库
+func DumpConnArgs(dbname string) []string {
+	return []string{"-d", DbConnInfo(dbname)}
+}
+
+// 创建数据库连接
 func CreateDbConn(dbname string) *sql.DB {
 	var db *sql.DB
 
-	connStr := fmt.Sprintf("host=localhost port=5432 user=gpadmin dbname=%s sslmode=disable", dbname)
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", DbConnInfo(dbname))
 	if err != nil {
 		LogError("Failed to connect database(%s): %s", dbname, err.Error())
-		os.Exit(1)
+		Exit(1)
 	}
 	return db
 }
@@ -83,7 +161,7 @@ func PutFileToS3(filePath string, objectKey string) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		LogError("Failed to open file(%s) for put file to s3: %s", filePath, err.Error())
-		os.Exit(1)
+		Exit(1)
 	}
 	defer file.Close()
 
@@ -91,14 +169,25 @@ func PutFileToS3(filePath string, objectKey string) {
 	fileInfo, err := file.Stat()
 	if err != nil {
 		LogError("Failed to get file(%s) status for put file to s3: %s", filePath, err.Error())
-		os.Exit(1)
+		Exit(1)
 	}
 
 	ctx := context.Background()
-	_, err = s3client.PutObject(ctx, ArgConfig.S3Bucket, objectKey, file, fileInfo.Size(), minio.PutObjectOptions{ContentType: "application/octest-stream"})
+	if len(CryptKey) > 0 {
+		// 边加密边上传
+		reader, writer := io.Pipe()
+		go func() {
+			defer Recover()
+			writer.CloseWithError(EncryptStream(CryptKey, file, writer))
+		}()
+		_, err = s3client.PutObject(ctx, ArgConfig.S3Bucket, objectKey, reader, -1, minio.PutObjectOptions{ContentType: "application/octest-stream"})
+		reader.Close()
+	} else {
+		_, err = s3client.PutObject(ctx, ArgConfig.S3Bucket, objectKey, file, fileInfo.Size(), minio.PutObjectOptions{ContentType: "application/octest-stream"})
+	}
 	if err != nil {
 		LogError("Failed to put file(%s) to s3: %s", filePath, err.Error())
-		os.Exit(1)
+		Exit(1)
 	}
 }
 
@@ -109,7 +198,7 @@ func InitSess(hostlist []string) {
 		_, err := SessPool.GetClient(host)
 		if err != nil {
 			LogError("Failed to create ssh client for host(%s): %s", host, err.Error())
-			os.Exit(1)
+			Exit(1)
 		}
 	}
 }
@@ -121,13 +210,20 @@ func NewSSHClientPool() *SSHClientPool {
 	}
 }
 
-// GetClient 获取指定主机的 SSH 客户端
+// GetClient 获取指定主机的 SSH 客户端, 连接已断开时重新连接
 func (p *SSHClientPool) GetClient(host string) (*SSHClient, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	if client, ok := p.clients[host]; ok {
-		return client, nil
+		select {
+		case <-client.done:
+			// 保活检测到连接已断开
+			LogInfo("SSH connection to %s is lost, reconnecting", host)
+			delete(p.clients, host)
+		default:
+			return client, nil
+		}
 	}
 
 	// 创建新的 SSH 客户端
@@ -136,32 +232,181 @@ func (p *SSHClientPool) GetClient(host string) (*SSHClient, error) {
 		return nil, err
 	}
 
-	p.clients[host] = &SSHClient{Client: client}
+	p.clients[host] = &SSHClient{Client: client, done: make(chan struct{})}
+	go p.keepalive(host, p.clients[host])
 	return p.clients[host], nil
 }
 
+// 定时发送保活请求, 失败时关闭连接, 下次GetClient时重新连接
+func (p *SSHClientPool) keepalive(host string, client *SSHClient) {
+	defer Recover()
+	if ArgConfig.SSHKeepAlive <= 0 {
+		client.Client.Wait()
+		close(client.done)
+		return
+	}
+	interval := time.Duration(ArgConfig.SSHKeepAlive) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// 网络中断时请求可能一直没有响应, 超过保活间隔没有响应视为连接断开
+		reply := make(chan error, 1)
+		go func() {
+			defer Recover()
+			_, _, err := client.Client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		timer := time.NewTimer(interval)
+		var err error
+		select {
+		case err = <-reply:
+		case <-timer.C:
+			err = fmt.Errorf("no reply in %s", interval)
+		}
+		timer.Stop()
+		if err != nil {
+			LogInfo("SSH keepalive to %s failed: %s", host, err.Error())
+			client.Client.Close()
+			close(client.done)
+			return
+		}
+	}
+}
+
+// 丢弃已断开的连接
+func (p *SSHClientPool) dropClient(host string, client *SSHClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients[host] == client {
+		delete(p.clients, host)
+		client.Client.Close()
+	}
+}
+
+var (
+	authOnce    sync.Once
+	authMethods []ssh.AuthMethod
+	authErr     error
+)
+
+// ssh认证方式只初始化一次, 所有连接共用同一个ssh-agent连接
+func sshauth() ([]ssh.AuthMethod, error) {
+	authOnce.Do(func() {
+		authMethods, authErr = loadsshauth()
+	})
+	return authMethods, authErr
+}
+
+// ssh认证方式: ssh-agent和私钥文件, 未指定私钥文件时使用~/.ssh下的默认私钥
+func loadsshauth() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" && !ArgConfig.SSHNoAgent {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			LogInfo("Failed to connect ssh-agent(%s): %s", sock, err.Error())
+		} else {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	keyfiles := ArgConfig.SSHKeyFiles
+	explicit := len(keyfiles) > 0
+	if !explicit {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			keyfiles = append(keyfiles, filepath.Join(os.Getenv("HOME"), ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, keyfile := range keyfiles {
+		key, err := os.ReadFile(keyfile)
+		if err != nil {
+			if !explicit && os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("unable to read private key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse private key(%s): %v", keyfile, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no ssh private key or ssh-agent available")
+	}
+	return methods, nil
+}
+
+var (
+	hostKeyOnce     sync.Once
+	hostKeyCallback ssh.HostKeyCallback
+	hostKeyErr      error
+)
+
+// 主机密钥校验, 使用known_hosts文件
+func sshhostkey() (ssh.HostKeyCallback, error) {
+	if ArgConfig.SSHIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	hostKeyOnce.Do(func() {
+		hostKeyCallback, hostKeyErr = knownhosts.New(ArgConfig.SSHKnownHosts)
+	})
+	return hostKeyCallback, hostKeyErr
+}
+
+// known_hosts中该主机的密钥类型, 使服务端优先提供已知类型的密钥
+func sshhostkeyalgos(callback ssh.HostKeyCallback, addr string) []string {
+	_, placeholder, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	pubkey, err := ssh.NewPublicKey(placeholder.Public())
+	if err != nil {
+		return nil
+	}
+
+	var keyerr *knownhosts.KeyError
+	if !errors.As(callback(addr, &net.TCPAddr{IP: net.IPv4zero}, pubkey), &keyerr) {
+		return nil
+	}
+	var algos []string
+	for _, known := range keyerr.Want {
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algos = append(algos, known.Key.Type())
+	}
+	return algos
+}
+
 // createSSHClient 创建一个新的 SSH 客户端
 func createSSHClient(host string) (*ssh.Client, error) {
-	// 使用当前用户的私钥进行认证
-	key, err := os.ReadFile(os.Getenv("HOME") + "/.ssh/id_rsa")
+	auth, err := sshauth()
 	if err != nil {
-		return nil, fmt.Errorf("unable to read private key: %v", err)
+		return nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(key)
+	hostkey, err := sshhostkey()
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse private key: %v", err)
+		return nil, fmt.Errorf("unable to load known hosts(%s): %v", ArgConfig.SSHKnownHosts, err)
 	}
 
+	addr := net.JoinHostPort(host, strconv.Itoa(ArgConfig.SSHPort))
 	config := &ssh.ClientConfig{
-		User: "gpadmin", // 替换为你的用户名
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // 忽略主机密钥检查
+		User:            ArgConfig.SSHUser,
+		Auth:            auth,
+		HostKeyCallback: hostkey,
+		Timeout:         30 * time.Second,
+	}
+	if !ArgConfig.SSHIgnoreHostKey {
+		config.HostKeyAlgorithms = sshhostkeyalgos(hostkey, addr)
 	}
 
-	client, err := ssh.Dial("tcp", host+":22", config)
+	client, err := ssh.Dial("tcp", addr, config)
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to %s: %v", host, err)
 	}
@@ -169,17 +414,32 @@ func createSSHClient(host string) (*ssh.Client, error) {
 	return client, nil
 }
 
+// 创建ssh会话, 连接断开时重新连接一次
+func (p *SSHClientPool) newSession(host string) (*ssh.Session, error) {
+	for retry := 0; ; retry++ {
+		client, err := p.GetClient(host)
+		if err != nil {
+			return nil, err
+		}
+
+		session, err := client.Client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+		p.dropClient(host, client)
+		if retry > 0 {
+			return nil, fmt.Errorf("unable to create session: %v", err)
+		}
+		LogInfo("Failed to create ssh session on %s, reconnecting: %s", host, err.Error())
+	}
+}
+
 // ExecuteCommand 在指定主机上执行命令
 func (p *SSHClientPool) ExecuteCommand(host, command string) (string, error) {
-	client, err := p.GetClient(host)
+	session, err := p.newSession(host)
 	if err != nil {
 		return "", err
 	}
-
-	session, err := client.Client.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("unable to create session: %v", err)
-	}
 	defer session.Close()
 
 	output, err := session.CombinedOutput(command)
@@ -278,46 +538,63 @@ func CreS3Yaml(ts string, gphome string, hostlist []string) {
 			"aws_access_key_id":     ArgConfig.S3Id,
 			"aws_secret_access_key": ArgConfig.S3Key,
 			"bucket":                ArgConfig.S3Bucket,
-			"endpoint":              fmt.Sprintf("http://%s", ArgConfig.S3Endpoint),
+			"endpoint":              S3EndpointUrl(),
 			"folder":                ArgConfig.S3Folder,
+			"encryption":            "off",
 		},
 	}
+	// 插件的encryption表示是否使用https
+	options := s3config["options"].(map[string]interface{})
+	if ArgConfig.S3TLS {
+		options["encryption"] = "on"
+	}
+	if ArgConfig.S3Region != "" {
+		options["region"] = ArgConfig.S3Region
+	}
 
 	yamls3config, err := yaml.Marshal(s3config)
 	if err != nil {
 		LogError("Failed to marshal s3 config: %s", err.Error())
-		os.Exit(1)
-	}
-
-	file, err := os.Create(fmt.Sprintf("/tmp/gpdbbr_%s_s3.yaml", ts))
-	if err != nil {
-		LogError("Failed to create s3 config file(%s): %s", fmt.Sprintf("/tmp/gpdbbr_%s_s3.yaml", ts), err.Error())
-		os.Exit(1)
+		Exit(1)
 	}
-	defer file.Close()
 
-	_, err = file.Write(yamls3config)
-	if err != nil {
-		LogError("Failed to write s3 config file(%s): %s", fmt.Sprintf("/tmp/gpdbbr_%s_s3.yaml", ts), err.Error())
-		os.Exit(1)
+	// 配置文件中有s3密钥, 只有所有者可以读取
+	files := []HostFile{{Path: fmt.Sprintf("/tmp/gpdbbr_%s_s3.yaml", ts), Data: yamls3config, Mode: 0600}}
+	// 插件通过AWS_CA_BUNDLE环境变量读取CA证书
+	if ArgConfig.S3CAFile != "" {
+		ca, err := os.ReadFile(ArgConfig.S3CAFile)
+		if err != nil {
+			LogError("Failed to read s3 ca file(%s): %s", ArgConfig.S3CAFile, err.Error())
+			Exit(1)
+		}
+		files = append(files, HostFile{Path: s3cabundle(ts), Data: ca, Mode: 0644})
 	}
 
 	// 下发文件
-	for _, host := range hostlist {
-		ok, output := ExecOsCmd("scp", []string{fmt.Sprintf("/tmp/gpdbbr_%s_s3.yaml", ts), fmt.Sprintf("%s:/tmp/gpdbbr_%s_s3.yaml", host, ts)})
-		if !ok {
-			LogError("Failed to issue s3 config file to host(%s): %s", host, output)
-			os.Exit(1)
-		}
+	err = DistributeFiles(hostlist, files)
+	if err != nil {
+		LogError("Failed to issue s3 config file: %s", err.Error())
+		Exit(1)
 	}
 }
 
 func CreS3Client() *minio.Client {
-	s3client, err := minio.New(ArgConfig.S3Endpoint, &minio.Options{Creds: credentials.NewStaticV4(
-		ArgConfig.S3Id, ArgConfig.S3Key, ""), Secure: false})
+	transport, err := s3transport()
+	if err != nil {
+		LogError("Failed to create s3 client: %s", err.Error())
+		Exit(1)
+	}
+
+	s3client, err := minio.New(ArgConfig.S3Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(ArgConfig.S3Id, ArgConfig.S3Key, ArgConfig.S3SessionToken),
+		Secure:       ArgConfig.S3TLS,
+		Region:       ArgConfig.S3Region,
+		BucketLookup: s3bucketlookup(),
+		Transport:    transport,
+	})
 	if err != nil {
 		LogError("Failed to create s3 client: %s", err.Error())
-		os.Exit(1)
+		Exit(1)
 	}
 
 	return s3client
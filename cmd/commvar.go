@@ -16,6 +16,59 @@ type Config struct {
 	S3Key      string
 	S3Bucket   string
 	S3Folder   string
+	// s3连接: 是否使用https, CA证书, 是否跳过证书校验, 区域, bucket访问方式, 临时凭证
+	S3TLS          bool
+	S3CAFile       string
+	S3SkipVerify   bool
+	S3Region       string
+	S3BucketLookup string
+	S3SessionToken string
+	// 数据库连接, 密码使用PGPASSWORD或.pgpass
+	DbHost    string
+	DbPort    int
+	DbUser    string
+	DbSSLMode string
+	// ssh连接: 用户, 端口, 私钥文件, 是否不使用ssh-agent, known_hosts文件, 是否忽略主机密钥, 保活间隔秒数
+	SSHUser          string
+	SSHPort          int
+	SSHKeyFiles      []string
+	SSHNoAgent       bool
+	SSHKnownHosts    string
+	SSHIgnoreHostKey bool
+	SSHKeepAlive     int
+	// 本地工作目录, 是否保留上传后的本地文件
+	WorkDir   string
+	KeepLocal bool
+	Json      bool
+	KeepDays  int
+	KeepLast  int
+	KeepFulls int
+	// prune时不再保留备份集的备集群: 指定的主机, 超过天数没有上报还原进度的备集群
+	IgnoreStandby []string
+	StandbyMaxAge int
+	DryRun        bool
+	Full          bool
+	Filter        TableFilter
+	Resume        string
+	BreakLock     bool
+	// heap表变化检测方式: stat 通过ssh获取文件修改时间, counter 通过统计信息计数, pgstatfile 通过pg_stat_file获取文件修改时间
+	HeapDetector string
+	InsertOnly   []string
+	// 表数据压缩方式, 编码:级别
+	Compression string
+	Timestamp   string
+	Deep        bool
+	LogFile     string
+	// prometheus指标: node_exporter textfile路径和 /metrics 监听地址
+	MetricsFile   string
+	MetricsListen string
+	// 任务完成通知: 地址, 重试次数, 签名密钥和json模板文件
+	NotifyUrl      string
+	NotifyRetries  int
+	NotifySecret   string
+	NotifyTemplate string
+	// 配置文件中的表级别策略
+	TablePolicies []TablePolicy
 }
 
 var ArgConfig Config
@@ -23,6 +76,7 @@ var ArgConfig Config
 // SSHClient 表示一个 SSH 客户端
 type SSHClient struct {
 	Client *ssh.Client
+	done   chan struct{} // 连接断开时关闭
 }
 
 // SSHClientPool 用于管理多个 SSH 客户端会话
@@ -41,16 +95,51 @@ type BkMetaData struct {
 	DdlSqls             []string            `yaml:"ddls"`
 	IncrementalMetadata IncrementalMetadata `yaml:"incrementalmetadata"`
 	FailTables          []string            `yaml:"failtables"`
+	CarriedTables       []string            `yaml:"carriedtables"`
 	UserList            []string            `yaml:"userlist"`
 	TableRows           map[string]float64  `yaml:"tablerows"`
+	TableFilter         TableFilter         `yaml:"tablefilter"`
+	SegSnapshots        map[int]string      `yaml:"segsnapshots"` // 各segment的本地快照, 用于导出之后新增的数据
+}
+
+// 备份进度, 每张表完成后写入s3, 用于断点续传
+type BkProgress struct {
+	SnapShot            string              `yaml:"snapshot"`
+	UnixTime            string              `yaml:"unixtime"`
+	BackupType          string              `yaml:"backuptype"`
+	UpdateTime          string              `yaml:"updatetime"`
+	DataEntries         []DataEntry         `yaml:"dataentries"`
+	DdlSqls             []string            `yaml:"ddls"`
+	IncrementalMetadata IncrementalMetadata `yaml:"incrementalmetadata"`
+	SegSnapshots        map[int]string      `yaml:"segsnapshots,omitempty"`
+	KeySalt             string              `yaml:"keysalt,omitempty"`
+	// 快照之前收集的heap表变化信息和快照之后收集的只插入表统计信息计数
+	HeapCounters map[string]HeapMetadata `yaml:"heapcounters,omitempty"`
+	HeapStats    map[string]HeapMetadata `yaml:"heapstats,omitempty"`
+	SnapCounters map[string]HeapMetadata `yaml:"snapcounters,omitempty"`
+}
+
+// 表过滤条件, 表名格式为 schema.table
+type TableFilter struct {
+	IncludeSchema []string `yaml:"includeschema,omitempty"`
+	ExcludeSchema []string `yaml:"excludeschema,omitempty"`
+	IncludeTable  []string `yaml:"includetable,omitempty"`
+	ExcludeTable  []string `yaml:"excludetable,omitempty"`
 }
 
 // 定义 JobInfo 结构体
 type JobInfo struct {
-	Status    string `yaml:"status"`
-	DBName    string `yaml:"dbname"`
-	BeginTime string `yaml:"begintime"`
-	EndTime   string `yaml:"endtime"`
+	Status     string `yaml:"status"`
+	DBName     string `yaml:"dbname"`
+	BackupType string `yaml:"backuptype"`
+	ChainId    string `yaml:"chainid"`
+	BeginTime  string `yaml:"begintime"`
+	EndTime    string `yaml:"endtime"`
+	SynthFrom  string `yaml:"synthfrom,omitempty"`
+	// 加密密钥的指纹, 为空表示没有加密
+	KeyFingerprint string `yaml:"keyfingerprint,omitempty"`
+	// 口令派生密钥的盐值, 同一个备份链沿用相同的盐值
+	KeySalt string `yaml:"keysalt,omitempty"`
 }
 
 // 定义 DataEntry 结构体
@@ -58,6 +147,28 @@ type DataEntry struct {
 	TableName       string `yaml:"name"`
 	OID             string `yaml:"oid"`
 	AttributeString string `yaml:"attributestring"`
+	Delta           bool   `yaml:"delta,omitempty"`       // 只包含上一个备份集之后新增的数据, 还原时追加
+	FileKey         string `yaml:"filekey,omitempty"`     // 数据文件名中的标识, 为空时使用OID
+	Compression     string `yaml:"compression,omitempty"` // 数据文件的压缩方式, 为空时为gzip:1
+	Encrypted       bool   `yaml:"encrypted,omitempty"`   // 数据文件是否加密
+	Reason          string `yaml:"reason,omitempty"`      // 备份该表的原因
+	// 各segment上传的数据文件, 用于校验备份集
+	Objects []DataObject `yaml:"objects,omitempty"`
+}
+
+// 数据文件在s3上的对象信息
+type DataObject struct {
+	SegId string `yaml:"segid" json:"segid"`
+	Size  int64  `yaml:"size" json:"size"`
+	ETag  string `yaml:"etag" json:"etag"`
+}
+
+// 数据文件名中的标识, gpdbbr_<segid>_<timestamp>_<fileid>.<ext>
+func (e DataEntry) FileId() string {
+	if e.FileKey != "" {
+		return e.FileKey
+	}
+	return e.OID
 }
 
 // 定义 IncrementalMetadata 结构体
@@ -68,19 +179,57 @@ type IncrementalMetadata struct {
 
 // 定义 AO 表的元数据结构体
 type AoMetadata struct {
-	ModCount    int    `yaml:"modcount"`
-	LastDDLTime string `yaml:"lastddltime"`
+	ModCount    int         `yaml:"modcount"`
+	LastDDLTime string      `yaml:"lastddltime"`
+	SegFiles    []AoSegFile `yaml:"segfiles,omitempty"`    // 各segment上每个segfile的状态, 用于判断是否只有追加
+	VisimapHash string      `yaml:"visimaphash,omitempty"` // 可见性映射表的摘要, 发生变化说明有删除或更新
+}
+
+// AO表segfile的状态
+type AoSegFile struct {
+	SegId    int   `yaml:"segid"`
+	SegNo    int   `yaml:"segno"`
+	Eof      int64 `yaml:"eof"`
+	TupCount int64 `yaml:"tupcount"`
+	State    int   `yaml:"state"`
+	// 已经分配的最大行号, 之后追加的行的行号都大于该值
+	LastRowNum int64 `yaml:"lastrownum,omitempty"`
 }
 
 // 定义 Heap 表的统计信息结构体
 type HeapMetadata struct {
-	MaxStat int `yaml:"maxstat"`
+	Detector        string `yaml:"detector,omitempty"`
+	MaxStat         int    `yaml:"maxstat"`
+	InsTup          int64  `yaml:"instup,omitempty"`
+	UpdTup          int64  `yaml:"updtup,omitempty"`
+	DelTup          int64  `yaml:"deltup,omitempty"`
+	ModSinceAnalyze int64  `yaml:"modsinceanalyze,omitempty"`
+	FileNode        int64  `yaml:"filenode,omitempty"`  // 所有segment的relfilenode之和, truncate和vacuum full会改变
+	DeltaBase       bool   `yaml:"deltabase,omitempty"` // 获取快照期间阻塞了写入, 下一次备份可以只备份之后新增的数据
+}
+
+// 备份集, 对应s3上的 backups/<date>/<timestamp>/ 目录
+type BkSet struct {
+	Date string
+	Time string
+}
+
+// 备集群的还原进度, 存放在s3的 standbys/ 目录下
+type StandbyInfo struct {
+	Host        string `yaml:"host"`
+	DBName      string `yaml:"dbname"`
+	RestoreDate string `yaml:"restoredate"`
+	RestoreTime string `yaml:"restoretime"`
+	UpdateTime  string `yaml:"updatetime"`
 }
 
 type RsRpt struct {
 	Status     string   `yaml:"status"`
+	ChainId    string   `yaml:"chainid"`
 	BeginTime  string   `yaml:"begintime"`
 	EndTime    string   `yaml:"endtime"`
 	FailTables []string `yaml:"failtables"`
 	FailDDLs   []string `yaml:"failddl"`
+	// 备份失败的表, 由下一个备份集补充
+	CarriedTables []string `yaml:"carriedtables"`
 }
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 旧版本备份集没有记录压缩方式, 使用 gzip -1
+const DefaultCompression = "gzip:1"
+
+// 解析压缩方式, 返回规范化后的 编码:级别, 例如 gzip:1, zstd:3, lz4, none
+func ParseCompression(value string) (string, error) {
+	codec, levelstr, haslevel := strings.Cut(strings.ToLower(strings.TrimSpace(value)), ":")
+
+	var minlevel, maxlevel, deflevel int
+	switch codec {
+	case "gzip":
+		minlevel, maxlevel, deflevel = 1, 9, 1
+	case "zstd":
+		minlevel, maxlevel, deflevel = 1, 19, 3
+	case "lz4", "none":
+		if haslevel {
+			return "", fmt.Errorf("%s does not take a level", codec)
+		}
+		return codec, nil
+	default:
+		return "", fmt.Errorf("unknown codec %s, must be gzip, zstd, lz4 or none", codec)
+	}
+
+	level := deflevel
+	if haslevel {
+		var err error
+		level, err = strconv.Atoi(levelstr)
+		if err != nil || level < minlevel || level > maxlevel {
+			return "", fmt.Errorf("%s level must be in range [%d-%d]", codec, minlevel, maxlevel)
+		}
+	}
+	return fmt.Sprintf("%s:%d", codec, level), nil
+}
+
+// 数据文件的压缩方式
+func (e DataEntry) Codec() string {
+	if e.Compression == "" {
+		return DefaultCompression
+	}
+	return e.Compression
+}
+
+// 备份时的压缩管道, 放在s3插件之前
+func CompressPipe(compression string) string {
+	codec, level, _ := strings.Cut(compression, ":")
+	switch codec {
+	case "gzip":
+		return fmt.Sprintf("gzip -c -%s | ", level)
+	case "zstd":
+		return fmt.Sprintf("zstd -q -c -%s | ", level)
+	case "lz4":
+		return "lz4 -q -c | "
+	}
+	return ""
+}
+
+// 还原时的解压管道, 放在s3插件之后
+func DecompressPipe(compression string) string {
+	codec, _, _ := strings.Cut(compression, ":")
+	switch codec {
+	case "gzip":
+		return " | gzip -d -c"
+	case "zstd":
+		return " | zstd -q -d -c"
+	case "lz4":
+		return " | lz4 -q -d -c"
+	}
+	return ""
+}
+
+// 数据文件的扩展名
+func DataFileExt(compression string) string {
+	codec, _, _ := strings.Cut(compression, ":")
+	switch codec {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	case "lz4":
+		return ".lz4"
+	}
+	return ".csv"
+}
+
+// 数据文件名, gpdbbr_<segid>_<timestamp>_<fileid>.<ext>
+func DataFileName(segid string, timestamp string, fileid string, compression string) string {
+	return fmt.Sprintf("gpdbbr_%s_%s_%s%s", segid, timestamp, fileid, DataFileExt(compression))
+}
+
+// 去掉数据文件的扩展名, 不是数据文件时返回false
+func TrimDataFileExt(name string) (string, bool) {
+	for _, ext := range []string{".gz", ".zst", ".lz4", ".csv"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), true
+		}
+	}
+	return name, false
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 配置文件中的表级别策略
+type TablePolicy struct {
+	Table       string `yaml:"table"`       // schema.table
+	Exclude     bool   `yaml:"exclude"`     // 不备份该表
+	Compression string `yaml:"compression"` // 该表使用的压缩方式
+}
+
+// ${VAR} 或 ${VAR:-default}
+var configEnvRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// 替换配置值中的环境变量, 环境变量未设置且没有默认值时报错
+func expandconfigenv(value string) (string, error) {
+	var err error
+	result := configEnvRe.ReplaceAllStringFunc(value, func(match string) string {
+		parts := configEnvRe.FindStringSubmatch(match)
+		if env, ok := os.LookupEnv(parts[1]); ok {
+			return env
+		}
+		if parts[2] != "" {
+			return parts[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", parts[1])
+		}
+		return match
+	})
+	return result, err
+}
+
+// 检查配置文件权限, 和.pgpass一样, 组和其他用户有权限时拒绝读取
+func checkconfigperm(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s has group or world access, permissions should be u=rw (0600) or less", file)
+	}
+	return nil
+}
+
+// 读取配置文件, 配置项和命令行参数同名, 命令行中指定的参数优先
+// 列表参数可以写成yaml数组, tables为表级别策略
+func LoadConfigFile(file string, setflags map[string]bool) ([]TablePolicy, error) {
+	if err := checkconfigperm(file); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file must be a mapping of option names to values")
+	}
+
+	var policies []TablePolicy
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, value := doc.Content[i].Value, doc.Content[i+1]
+
+		if key == "tables" {
+			if err := value.Decode(&policies); err != nil {
+				return nil, fmt.Errorf("tables: %s", err.Error())
+			}
+			for i := range policies {
+				if policies[i].Compression, err = expandconfigenv(policies[i].Compression); err != nil {
+					return nil, fmt.Errorf("tables: %s", err.Error())
+				}
+			}
+			continue
+		}
+
+		f := flag.Lookup(key)
+		if f == nil || key == "config" {
+			return nil, fmt.Errorf("unknown option %s (line %d)", key, doc.Content[i].Line)
+		}
+		if setflags[key] {
+			continue
+		}
+
+		var items []*yaml.Node
+		switch value.Kind {
+		case yaml.ScalarNode:
+			items = []*yaml.Node{value}
+		case yaml.SequenceNode:
+			items = value.Content
+		default:
+			return nil, fmt.Errorf("option %s must be a value or a list (line %d)", key, value.Line)
+		}
+		for _, item := range items {
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("option %s must be a value or a list (line %d)", key, item.Line)
+			}
+			v, err := expandconfigenv(item.Value)
+			if err != nil {
+				return nil, fmt.Errorf("option %s: %s", key, err.Error())
+			}
+			if err := flag.Set(key, v); err != nil {
+				return nil, fmt.Errorf("option %s: %s", key, err.Error())
+			}
+		}
+	}
+
+	return policies, nil
+}
+
+// 表使用的压缩方式, 配置文件中有表级别策略时使用表的压缩方式
+func TableCompression(tabname string) string {
+	tabname = strings.ReplaceAll(tabname, "\"", "")
+	for _, policy := range ArgConfig.TablePolicies {
+		if policy.Table == tabname && policy.Compression != "" {
+			return policy.Compression
+		}
+	}
+	return ArgConfig.Compression
+}
@@ -0,0 +1,414 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 加密数据格式:
+// 文件头 魔数(8字节) + 密钥指纹(8字节) + 口令派生密钥的盐值(16字节) + 文件盐值(32字节)
+// 每个文件使用 HKDF(密钥, 文件盐值) 派生独立的子密钥, 块序号作为随机数不会重复
+// 之后是若干数据块, 每块为 密文长度(4字节) + 密文, 最后一块标记为结束块, 用于发现截断
+const (
+	cryptMagic     = "GPDBBRE1"
+	cryptChunkSize = 1 << 20
+	cryptKeySize   = 32
+	cryptSaltSize  = 16
+	cryptFileSalt  = 32
+	cryptHeader    = len(cryptMagic) + 8 + cryptSaltSize + cryptFileSalt
+)
+
+var (
+	// 加密密钥, 未设置时不加密
+	CryptKey []byte
+	// 口令派生CryptKey使用的盐值, 使用密钥文件时为全0
+	cryptKeySalt = make([]byte, cryptSaltSize)
+	// 加密口令, 读取其他盐值派生的数据时重新派生密钥
+	cryptPass  []byte
+	cryptKeys  = make(map[string][]byte)
+	cryptKeyMu sync.Mutex
+)
+
+// 读取加密密钥, 密钥文件为32字节或64位十六进制, 口令文件或环境变量中的口令使用scrypt和随机盐值派生密钥
+func LoadCryptKey(keyfile string, passfile string) error {
+	if keyfile != "" {
+		data, err := os.ReadFile(keyfile)
+		if err != nil {
+			return err
+		}
+		if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == cryptKeySize {
+			CryptKey = key
+		} else if len(data) == cryptKeySize {
+			CryptKey = data
+		} else {
+			return fmt.Errorf("key file must contain 32 bytes or 64 hex characters")
+		}
+		return nil
+	}
+
+	var passphrase string
+	if passfile != "" {
+		data, err := os.ReadFile(passfile)
+		if err != nil {
+			return err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	} else {
+		passphrase = os.Getenv("GPDBBR_ENCRYPT_PASSPHRASE")
+	}
+	if passphrase == "" {
+		return nil
+	}
+	cryptPass = []byte(passphrase)
+
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	return UseKeySalt(hex.EncodeToString(salt))
+}
+
+// 口令派生当前密钥的盐值, 记录在备份集中, 同一个备份链沿用相同的盐值和密钥
+func KeySalt() string {
+	if len(cryptPass) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(cryptKeySalt)
+}
+
+// 使用备份集记录的盐值重新派生当前密钥, 使用密钥文件或者盐值为空时不变
+func UseKeySalt(salt string) error {
+	if len(cryptPass) == 0 || salt == "" {
+		return nil
+	}
+	saltbytes, err := hex.DecodeString(salt)
+	if err != nil || len(saltbytes) != cryptSaltSize {
+		return fmt.Errorf("invalid key salt %s", salt)
+	}
+	key, err := derivekey(saltbytes)
+	if err != nil {
+		return err
+	}
+	CryptKey = key
+	cryptKeySalt = saltbytes
+	return nil
+}
+
+// 使用口令和盐值派生密钥, 同一个盐值只派生一次
+func derivekey(salt []byte) ([]byte, error) {
+	cryptKeyMu.Lock()
+	defer cryptKeyMu.Unlock()
+	if key, ok := cryptKeys[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key(cryptPass, salt, 1<<15, 8, 1, cryptKeySize)
+	if err != nil {
+		return nil, err
+	}
+	cryptKeys[string(salt)] = key
+	return key, nil
+}
+
+// 密钥指纹, 记录在备份集中用于还原前检查密钥
+func KeyFingerprint(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte("gpdbbr key fingerprint:"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// 检查备份集的密钥指纹是否和当前密钥一致
+func CheckKeyFingerprint(fingerprint string) error {
+	if fingerprint == "" {
+		return nil
+	}
+	if len(CryptKey) == 0 {
+		return fmt.Errorf("data is encrypted with key %s, an encryption key is required", fingerprint)
+	}
+	if fingerprint != KeyFingerprint(CryptKey) {
+		return fmt.Errorf("data is encrypted with key %s, but the supplied key is %s", fingerprint, KeyFingerprint(CryptKey))
+	}
+	return nil
+}
+
+// 找到文件头中的密钥指纹对应的密钥, 口令派生的密钥使用文件头中的盐值重新派生
+func headerkey(key []byte, fingerprint string, keysalt []byte) ([]byte, error) {
+	if len(key) > 0 && KeyFingerprint(key) == fingerprint {
+		return key, nil
+	}
+	if len(cryptPass) > 0 && !bytes.Equal(keysalt, make([]byte, cryptSaltSize)) {
+		derived, err := derivekey(keysalt)
+		if err != nil {
+			return nil, err
+		}
+		if KeyFingerprint(derived) == fingerprint {
+			return derived, nil
+		}
+		return nil, fmt.Errorf("data is encrypted with key %s, but the passphrase derives key %s", fingerprint, KeyFingerprint(derived))
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("data is encrypted with key %s, an encryption key is required", fingerprint)
+	}
+	return nil, fmt.Errorf("data is encrypted with key %s, but the supplied key is %s", fingerprint, KeyFingerprint(key))
+}
+
+// 使用密钥和文件盐值派生文件的子密钥
+func newgcm(key []byte, filesalt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, cryptKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, filesalt, []byte("gpdbbr data key")), subkey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 每块的随机数为块序号
+func chunknonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// 每块的附加数据为 文件头 + 是否为最后一块
+func chunkaad(header []byte, last bool) []byte {
+	aad := append([]byte{}, header...)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// 加密数据流
+func EncryptStream(key []byte, r io.Reader, w io.Writer) error {
+	if len(key) != cryptKeySize {
+		return fmt.Errorf("invalid encryption key length %d", len(key))
+	}
+	keysalt := make([]byte, cryptSaltSize)
+	if bytes.Equal(key, CryptKey) {
+		keysalt = cryptKeySalt
+	}
+	filesalt := make([]byte, cryptFileSalt)
+	if _, err := rand.Read(filesalt); err != nil {
+		return err
+	}
+	gcm, err := newgcm(key, filesalt)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, _ := hex.DecodeString(KeyFingerprint(key))
+	header := append(append(append([]byte(cryptMagic), fingerprint...), keysalt...), filesalt...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// 预读下一块, 判断当前块是否为最后一块
+	cur := make([]byte, cryptChunkSize)
+	next := make([]byte, cryptChunkSize)
+	n, err := io.ReadFull(r, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	var seq uint64
+	for {
+		var m int
+		if !last {
+			m, err = io.ReadFull(r, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if m == 0 {
+				last = true
+			}
+		}
+
+		sealed := gcm.Seal(nil, chunknonce(seq), cur[:n], chunkaad(header, last))
+		lenbuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(lenbuf, uint32(len(sealed)))
+		if _, err := w.Write(lenbuf); err != nil {
+			return err
+		}
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+
+		seq++
+		cur, next = next, cur
+		n = m
+		last = err != nil
+	}
+}
+
+// 解密数据流, 密钥不匹配或数据被截断时返回错误
+func DecryptStream(key []byte, r io.Reader, w io.Writer) error {
+	header := make([]byte, cryptHeader)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("invalid encrypted data header: %s", err.Error())
+	}
+	if string(header[:len(cryptMagic)]) != cryptMagic {
+		return errors.New("data is not encrypted by gpdbbr")
+	}
+	fingerprint := hex.EncodeToString(header[len(cryptMagic) : len(cryptMagic)+8])
+	keysalt := header[len(cryptMagic)+8 : len(cryptMagic)+8+cryptSaltSize]
+	filesalt := header[len(cryptMagic)+8+cryptSaltSize:]
+	key, err := headerkey(key, fingerprint, keysalt)
+	if err != nil {
+		return err
+	}
+	gcm, err := newgcm(key, filesalt)
+	if err != nil {
+		return err
+	}
+
+	lenbuf := make([]byte, 4)
+	var seq uint64
+	for {
+		if _, err := io.ReadFull(r, lenbuf); err != nil {
+			return errors.New("encrypted data is truncated")
+		}
+		size := binary.BigEndian.Uint32(lenbuf)
+		if size > cryptChunkSize+uint32(gcm.Overhead()) {
+			return errors.New("encrypted data is corrupted")
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return errors.New("encrypted data is truncated")
+		}
+
+		nonce := chunknonce(seq)
+		last := true
+		plain, err := gcm.Open(nil, nonce, sealed, chunkaad(header, true))
+		if err != nil {
+			last = false
+			plain, err = gcm.Open(nil, nonce, sealed, chunkaad(header, false))
+			if err != nil {
+				return errors.New("failed to decrypt data, wrong key or corrupted data")
+			}
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		seq++
+	}
+}
+
+// 加密小对象, 未设置密钥时原样返回
+func EncryptBytes(data []byte) ([]byte, error) {
+	if len(CryptKey) == 0 {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	if err := EncryptStream(CryptKey, bytes.NewReader(data), &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 解密小对象, 没有加密的数据原样返回
+func DecryptBytes(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(cryptMagic)) {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	if err := DecryptStream(CryptKey, bytes.NewReader(data), &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// segment上COPY管道使用的加解密过滤器: gpdbbr encrypt|decrypt <keyfile>
+// 密钥文件为 密钥(32字节) + 口令派生密钥的盐值(16字节)
+func CryptFilter(mode string, keyfile string) {
+	data, err := os.ReadFile(keyfile)
+	if err != nil || len(data) != cryptKeySize+cryptSaltSize {
+		fmt.Fprintf(os.Stderr, "gpdbbr %s: invalid key file %s\n", mode, keyfile)
+		os.Exit(1)
+	}
+	key := data[:cryptKeySize]
+	CryptKey = key
+	cryptKeySalt = data[cryptKeySize:]
+
+	reader := bufio.NewReaderSize(os.Stdin, cryptChunkSize)
+	writer := bufio.NewWriterSize(os.Stdout, cryptChunkSize)
+	if mode == "encrypt" {
+		err = EncryptStream(key, reader, writer)
+	} else {
+		err = DecryptStream(key, reader, writer)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gpdbbr %s: %s\n", mode, err.Error())
+		os.Exit(1)
+	}
+}
+
+// segment上的加解密程序和密钥文件
+func cryptbin(ts string) string { return fmt.Sprintf("/tmp/gpdbbr_%s_crypt", ts) }
+func cryptkey(ts string) string { return fmt.Sprintf("/tmp/gpdbbr_%s_key", ts) }
+
+// 备份时的加密管道, 放在压缩之后
+func EncryptPipe(ts string) string {
+	if len(CryptKey) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s encrypt %s | ", cryptbin(ts), cryptkey(ts))
+}
+
+// 还原时的解密管道, 放在解压之前
+func DecryptPipe(ts string, encrypted bool) string {
+	if !encrypted {
+		return ""
+	}
+	return fmt.Sprintf(" | %s decrypt %s", cryptbin(ts), cryptkey(ts))
+}
+
+// 下发加解密程序和密钥文件到所有主机, 任务结束时删除
+func CreCryptFiles(ts string, hostlist []string) {
+	exe, err := os.Executable()
+	if err != nil {
+		LogError("Failed to get gpdbbr executable path: %s", err.Error())
+		Exit(1)
+	}
+	bin, err := os.ReadFile(exe)
+	if err != nil {
+		LogError("Failed to read gpdbbr executable(%s): %s", exe, err.Error())
+		Exit(1)
+	}
+
+	err = DistributeFiles(hostlist, []HostFile{
+		{Path: cryptkey(ts), Data: append(append([]byte{}, CryptKey...), cryptKeySalt...), Mode: 0600},
+		{Path: cryptbin(ts), Data: bin, Mode: 0700},
+	})
+	if err != nil {
+		LogError("Failed to issue encryption key: %s", err.Error())
+		Exit(1)
+	}
+}
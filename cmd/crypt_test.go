@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func testkey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, cryptKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, key []byte, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := EncryptStream(key, bytes.NewReader(plain), &buf); err != nil {
+		t.Fatalf("EncryptStream: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key []byte, sealed []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := DecryptStream(key, bytes.NewReader(sealed), &buf)
+	return buf.Bytes(), err
+}
+
+// 拆分为文件头和每个数据块(包含长度)
+func splitchunks(t *testing.T, sealed []byte) ([]byte, [][]byte) {
+	t.Helper()
+	header, rest := sealed[:cryptHeader], sealed[cryptHeader:]
+	var chunks [][]byte
+	for len(rest) > 0 {
+		size := int(binary.BigEndian.Uint32(rest[:4]))
+		chunks = append(chunks, rest[:4+size])
+		rest = rest[4+size:]
+	}
+	return header, chunks
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	key := testkey(t)
+	sizes := []int{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 2 * cryptChunkSize, 2*cryptChunkSize + 5}
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		if _, err := rand.Read(plain); err != nil {
+			t.Fatal(err)
+		}
+		sealed := encrypt(t, key, plain)
+
+		_, chunks := splitchunks(t, sealed)
+		wantchunks := size/cryptChunkSize + 1
+		if size > 0 && size%cryptChunkSize == 0 {
+			wantchunks = size / cryptChunkSize
+		}
+		if len(chunks) != wantchunks {
+			t.Errorf("size %d: got %d chunks, want %d", size, len(chunks), wantchunks)
+		}
+
+		got, err := decrypt(key, sealed)
+		if err != nil {
+			t.Fatalf("size %d: DecryptStream: %s", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestCryptUniqueFiles(t *testing.T) {
+	key := testkey(t)
+	plain := []byte("same data")
+	first := encrypt(t, key, plain)
+	second := encrypt(t, key, plain)
+	if bytes.Equal(first[cryptHeader:], second[cryptHeader:]) {
+		t.Error("encrypting the same data twice produced the same ciphertext")
+	}
+}
+
+func TestCryptTruncated(t *testing.T) {
+	key := testkey(t)
+	plain := make([]byte, 2*cryptChunkSize+5)
+	sealed := encrypt(t, key, plain)
+	header, chunks := splitchunks(t, sealed)
+
+	cases := map[string][]byte{
+		"header only":        header,
+		"partial header":     sealed[:cryptHeader-1],
+		"last chunk missing": append(append(append([]byte{}, header...), chunks[0]...), chunks[1]...),
+		"partial chunk":      sealed[:len(sealed)-1],
+	}
+	for name, data := range cases {
+		if _, err := decrypt(key, data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// 空数据也有结束块, 去掉之后不能解密
+	empty := encrypt(t, key, nil)
+	if _, err := decrypt(key, empty[:cryptHeader]); err == nil {
+		t.Error("empty data without the last chunk: expected an error")
+	}
+}
+
+func TestCryptReordered(t *testing.T) {
+	key := testkey(t)
+	plain := make([]byte, 2*cryptChunkSize+5)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+	header, chunks := splitchunks(t, encrypt(t, key, plain))
+
+	reordered := append([]byte{}, header...)
+	for _, i := range []int{1, 0, 2} {
+		reordered = append(reordered, chunks[i]...)
+	}
+	if _, err := decrypt(key, reordered); err == nil {
+		t.Error("reordered chunks: expected an error")
+	}
+
+	// 其他文件的数据块使用不同的子密钥
+	_, other := splitchunks(t, encrypt(t, key, plain))
+	mixed := append(append(append(append([]byte{}, header...), chunks[0]...), other[1]...), chunks[2]...)
+	if _, err := decrypt(key, mixed); err == nil {
+		t.Error("chunk from another file: expected an error")
+	}
+}
+
+func TestCryptWrongKey(t *testing.T) {
+	sealed := encrypt(t, testkey(t), []byte("data"))
+	if _, err := decrypt(testkey(t), sealed); err == nil {
+		t.Error("wrong key: expected an error")
+	}
+}
+
+func TestCryptPassphraseSalt(t *testing.T) {
+	defer func(key, salt, pass []byte) {
+		CryptKey, cryptKeySalt, cryptPass = key, salt, pass
+	}(CryptKey, cryptKeySalt, cryptPass)
+
+	cryptPass = []byte("passphrase")
+	if err := UseKeySalt(hex.EncodeToString(bytes.Repeat([]byte{1}, cryptSaltSize))); err != nil {
+		t.Fatal(err)
+	}
+	firstkey, firstsalt := CryptKey, KeySalt()
+	sealed := encrypt(t, CryptKey, []byte("data"))
+
+	// 其他盐值派生的密钥不同, 解密时使用文件头中的盐值重新派生
+	if err := UseKeySalt(hex.EncodeToString(bytes.Repeat([]byte{2}, cryptSaltSize))); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(firstkey, CryptKey) {
+		t.Fatal("different salts derived the same key")
+	}
+	got, err := decrypt(CryptKey, sealed)
+	if err != nil || string(got) != "data" {
+		t.Fatalf("decrypt with the passphrase: %v", err)
+	}
+
+	if err := UseKeySalt(firstsalt); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstkey, CryptKey) {
+		t.Error("the same salt derived a different key")
+	}
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 是否设置了过滤条件
+func (f TableFilter) IsEmpty() bool {
+	return len(f.IncludeSchema) == 0 && len(f.ExcludeSchema) == 0 && len(f.IncludeTable) == 0 && len(f.ExcludeTable) == 0
+}
+
+// 构造过滤条件的sql片段, relcol为空时只过滤schema
+func FilterSql(filter TableFilter, nspcol string, relcol string) string {
+	var conds []string
+
+	if len(filter.IncludeSchema) > 0 {
+		conds = append(conds, fmt.Sprintf("%s IN (%s)", nspcol, QuoteLiterals(filter.IncludeSchema)))
+	}
+	if len(filter.ExcludeSchema) > 0 {
+		conds = append(conds, fmt.Sprintf("%s NOT IN (%s)", nspcol, QuoteLiterals(filter.ExcludeSchema)))
+	}
+	if relcol != "" && len(filter.IncludeTable) > 0 {
+		conds = append(conds, fmt.Sprintf("%s||'.'||%s IN (%s)", nspcol, relcol, QuoteLiterals(filter.IncludeTable)))
+	}
+	if relcol != "" && len(filter.ExcludeTable) > 0 {
+		conds = append(conds, fmt.Sprintf("%s||'.'||%s NOT IN (%s)", nspcol, relcol, QuoteLiterals(filter.ExcludeTable)))
+	}
+
+	if len(conds) == 0 {
+		return ""
+	}
+	return "AND " + strings.Join(conds, " AND ")
+}
+
+// 构造pg_dump的过滤参数, 按schema过滤并排除指定的表, 包含的表在还原时处理
+// pg_dump指定-t时会忽略-n, 和FilterSql的语义不同, 并且只导出表会丢失类型, 函数和序列等对象
+// 名称加上双引号, pg_dump按原样匹配, 不转换大小写也不使用通配符, 和FilterSql保持一致
+func FilterDumpArgs(filter TableFilter) []string {
+	var dumpargs []string
+	for _, schema := range filter.IncludeSchema {
+		dumpargs = append(dumpargs, "-n", dumppattern(schema))
+	}
+	for _, schema := range filter.ExcludeSchema {
+		dumpargs = append(dumpargs, "-N", dumppattern(schema))
+	}
+	for _, tabname := range filter.ExcludeTable {
+		schema, table, _ := strings.Cut(tabname, ".")
+		dumpargs = append(dumpargs, "-T", dumppattern(schema)+"."+dumppattern(table))
+	}
+	return dumpargs
+}
+
+func dumppattern(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// 构造sql的字符串列表
+func QuoteLiterals(items []string) string {
+	var quoted []string
+	for _, item := range items {
+		quoted = append(quoted, "'"+strings.ReplaceAll(item, "'", "''")+"'")
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// 判断表是否满足过滤条件, 表名格式为 schema.table
+func MatchFilter(filter TableFilter, tabname string) bool {
+	schema, _, _ := strings.Cut(tabname, ".")
+	if len(filter.IncludeSchema) > 0 && !contains(filter.IncludeSchema, schema) {
+		return false
+	}
+	if contains(filter.ExcludeSchema, schema) {
+		return false
+	}
+	if len(filter.IncludeTable) > 0 && !contains(filter.IncludeTable, tabname) {
+		return false
+	}
+	return !contains(filter.ExcludeTable, tabname)
+}
+
+func contains(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
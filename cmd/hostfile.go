@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 下发到segment主机上的文件
+type HostFile struct {
+	Path string
+	Data []byte
+	Mode os.FileMode
+}
+
+// 下发文件的并发数
+const distributeJobs = 16
+
+// shell中使用的单引号字符串
+func shellquote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// 通过ssh会话写入文件, 先写临时文件再改名, 写入过程中文件权限不超过0600
+func (p *SSHClientPool) PutFile(host string, file HostFile) error {
+	session, err := p.newSession(host)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	tmpfile := shellquote(file.Path + ".tmp")
+	session.Stdin = bytes.NewReader(file.Data)
+	output, err := session.CombinedOutput(fmt.Sprintf("umask 077 && cat > %s && chmod %o %s && mv -f %s %s",
+		tmpfile, file.Mode.Perm(), tmpfile, tmpfile, shellquote(file.Path)))
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// 在所有主机上并行执行, 返回第一个错误
+// 退出函数中也会调用, 异常只作为该主机的错误返回, 不能调用Exit
+func forhosts(hostlist []string, do func(host string) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firsterr error
+	seterr := func(host string, err error) {
+		mu.Lock()
+		if firsterr == nil {
+			firsterr = fmt.Errorf("host %s: %v", host, err)
+		}
+		mu.Unlock()
+	}
+	sem := make(chan struct{}, distributeJobs)
+	for _, host := range hostlist {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				if r := recover(); r != nil {
+					seterr(host, fmt.Errorf("panic: %v", r))
+				}
+			}()
+			if err := do(host); err != nil {
+				seterr(host, err)
+			}
+		}(host)
+	}
+	wg.Wait()
+	return firsterr
+}
+
+// 并行下发文件到所有主机, 任务结束时(包括异常退出)删除这些文件
+func DistributeFiles(hostlist []string, files []HostFile) error {
+	if SessPool == nil {
+		SessPool = NewSSHClientPool()
+	}
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	OnExit(func(code int) {
+		RemoveHostFiles(hostlist, paths)
+	})
+
+	return forhosts(hostlist, func(host string) error {
+		for _, file := range files {
+			if err := SessPool.PutFile(host, file); err != nil {
+				return fmt.Errorf("failed to write %s: %v", file.Path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// 下发的文件属于ssh用户, COPY ... PROGRAM以数据库服务的系统用户执行, ssh用户必须是segment数据目录的所有者
+func CheckSegDirOwner(dbconn *sql.DB) {
+	rows, err := dbconn.Query("SELECT hostname, datadir FROM gp_segment_configuration WHERE role = 'p' AND content <> -1")
+	if err != nil {
+		LogError("Failed to get segment data directories: %s", err.Error())
+		Exit(1)
+	}
+	defer rows.Close()
+	hostdirs := make(map[string][]string)
+	var hostlist []string
+	for rows.Next() {
+		var host, datadir string
+		if err := rows.Scan(&host, &datadir); err != nil {
+			LogError("Failed to get segment data directories: %s", err.Error())
+			Exit(1)
+		}
+		if _, ok := hostdirs[host]; !ok {
+			hostlist = append(hostlist, host)
+		}
+		hostdirs[host] = append(hostdirs[host], shellquote(datadir))
+	}
+
+	if SessPool == nil {
+		SessPool = NewSSHClientPool()
+	}
+	err = forhosts(hostlist, func(host string) error {
+		output, err := SessPool.ExecuteCommand(host, fmt.Sprintf("for d in %s; do test -O \"$d\" || echo \"$d\"; done", strings.Join(hostdirs[host], " ")))
+		if err != nil {
+			return err
+		}
+		if output != "" {
+			return fmt.Errorf("ssh user %s does not own segment data directory %s", ArgConfig.SSHUser, strings.ReplaceAll(output, "\n", ", "))
+		}
+		return nil
+	})
+	if err != nil {
+		LogError("Segment processes can not read files written by the ssh user, use --ssh-user with the database server user: %s", err.Error())
+		Exit(1)
+	}
+}
+
+// 删除所有主机上下发的文件, 删除失败只记录日志
+func RemoveHostFiles(hostlist []string, paths []string) {
+	var quoted []string
+	for _, path := range paths {
+		quoted = append(quoted, shellquote(path), shellquote(path+".tmp"))
+	}
+	err := forhosts(hostlist, func(host string) error {
+		_, err := SessPool.ExecuteCommand(host, "rm -f "+strings.Join(quoted, " "))
+		return err
+	})
+	if err != nil {
+		LogInfo("Failed to remove %s: %s", strings.Join(paths, ", "), err.Error())
+	}
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// 表级别的日志字段
+type LogFields struct {
+	Table    string
+	Duration float64
+	Error    string
+}
+
+// json日志的一行
+type jsonLog struct {
+	Ts       string  `json:"ts"`
+	Level    string  `json:"level"`
+	Job      string  `json:"job,omitempty"`
+	DB       string  `json:"db,omitempty"`
+	Backup   string  `json:"backup,omitempty"`
+	Table    string  `json:"table,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Msg      string  `json:"msg"`
+}
+
+var (
+	logMu     sync.Mutex
+	logFile   *os.File
+	logFailed bool
+	jobLog    bytes.Buffer // 本次任务的日志, 任务结束后上传到备份集目录
+	logBkTime string       // 当前任务对应的备份集时间戳
+)
+
+// 设置日志中的备份集时间戳
+func SetLogTimestamp(ts string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logBkTime = ts
+}
+
+func LogInfoFields(fields LogFields, format string, v ...interface{}) {
+	logWithTag("INFO", fields, format, v...)
+}
+
+func LogErrorFields(fields LogFields, format string, v ...interface{}) {
+	logWithTag("ERROR", fields, format, v...)
+}
+
+// 写入json日志, 同时保留到任务日志中
+func writejsonlog(tag string, fields LogFields, message string) {
+	line := jsonLog{
+		Ts:       time.Now().Format("2006-01-02T15:04:05.000Z07:00"),
+		Level:    tag,
+		Job:      ArgConfig.Type,
+		DB:       ArgConfig.DbName,
+		Table:    fields.Table,
+		Duration: fields.Duration,
+		Error:    fields.Error,
+		Msg:      message,
+	}
+	if tag == "ERROR" && line.Error == "" {
+		line.Error = message
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	line.Backup = logBkTime
+	data, err := json.Marshal(&line)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	jobLog.Write(data)
+
+	if ArgConfig.LogFile == "" || logFailed {
+		return
+	}
+	if logFile == nil {
+		logFile, err = os.OpenFile(ArgConfig.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			// 日志文件不可写时只提示一次, 不影响任务
+			logFailed = true
+			fmt.Fprintf(os.Stderr, "gpdbbr: failed to open log file(%s): %s\n", ArgConfig.LogFile, err.Error())
+			return
+		}
+	}
+	logFile.Write(data)
+}
+
+// 任务退出时上传日志到备份集目录, 失败的任务也保留日志用于排查
+func PutJobLogOnExit(set BkSet, name string) {
+	OnExit(func(code int) {
+		PutJobLog(set, name)
+	})
+}
+
+// 上传本次任务的日志到备份集目录, 上传失败不影响任务
+func PutJobLog(set BkSet, name string) {
+	logMu.Lock()
+	data := append([]byte{}, jobLog.Bytes()...)
+	logMu.Unlock()
+
+	objectKey := fmt.Sprintf("%sgpdbbr_%s_%s.log", BkSetPrefix(set), set.Time, name)
+	data, err := EncryptBytes(data)
+	if err == nil {
+		_, err = CreS3Client().PutObject(context.Background(), ArgConfig.S3Bucket, objectKey, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "application/octest-stream"})
+	}
+	if err != nil {
+		LogError("Failed to upload job log(%s): %s", objectKey, err.Error())
+		return
+	}
+	LogInfo("Job log uploaded to %s", objectKey)
+}
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"gopkg.in/yaml.v3"
+)
+
+// 备份锁的租约时长和续约间隔
+const (
+	lockLease = 5 * time.Minute
+	lockRenew = time.Minute
+)
+
+// s3目录的备份锁, 同一时间只有一个备份、清理或合成任务写入该目录
+type BkLock struct {
+	Owner     string `yaml:"owner"` // 每次加锁生成的随机标识
+	Host      string `yaml:"host"`
+	Pid       int    `yaml:"pid"`
+	StartTime string `yaml:"starttime"`
+	Expiry    string `yaml:"expiry"`
+}
+
+var (
+	lockMu   sync.Mutex
+	heldLock *BkLock
+	lockETag string
+	// 指定--break-lock时, s3不支持条件写入也直接覆盖锁
+	lockForce  bool
+	lockNoCond bool
+)
+
+// 备份锁文件
+func BkLockFile() string {
+	return fmt.Sprintf("%s/gpdbbr.lock", ArgConfig.S3Folder)
+}
+
+// 读取备份锁, 锁不存在时返回nil
+func getlock(s3client *minio.Client) (*BkLock, string, error) {
+	object, err := s3client.GetObject(context.Background(), ArgConfig.S3Bucket, BkLockFile(), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer object.Close()
+
+	data, err := ioutil.ReadAll(object)
+	if err != nil {
+		if IsNoSuchKey(err) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	info, err := object.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var lock BkLock
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return nil, "", fmt.Errorf("failed to parse lock file(%s): %s", BkLockFile(), err.Error())
+	}
+	return &lock, info.ETag, nil
+}
+
+// 写入备份锁, etag为空时只在锁不存在时写入, 否则只在锁没有被其他任务修改时写入
+func putlock(s3client *minio.Client, lock *BkLock, etag string) (string, error) {
+	lock.Expiry = time.Now().Add(lockLease).Format(time.RFC3339)
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return "", err
+	}
+
+	opts := minio.PutObjectOptions{ContentType: "application/x-yaml"}
+	if etag == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(etag)
+	}
+	info, err := s3client.PutObject(context.Background(), ArgConfig.S3Bucket, BkLockFile(), bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil && minio.ToErrorResponse(err).Code == "NotImplemented" {
+		// 不支持条件写入时无法保证互斥, 只有指定--break-lock时才直接覆盖
+		if !lockForce {
+			return "", fmt.Errorf("s3 does not support conditional writes, the lock can not be taken safely, use --break-lock to write it without the condition")
+		}
+		if !lockNoCond {
+			LogInfo("S3 does not support conditional writes, writing lock(%s) without the condition", BkLockFile())
+			lockNoCond = true
+		}
+		info, err = s3client.PutObject(context.Background(), ArgConfig.S3Bucket, BkLockFile(), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "application/x-yaml"})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// 不支持条件写入的s3会直接覆盖, 写入后再读一次确认锁属于自己
+	current, _, err := getlock(s3client)
+	if err != nil {
+		return "", err
+	}
+	if current == nil || current.Owner != lock.Owner {
+		return "", fmt.Errorf("lock was taken by another job")
+	}
+	return info.ETag, nil
+}
+
+// 锁的描述, 用于日志
+func (l *BkLock) String() string {
+	return fmt.Sprintf("host %s, pid %d, started at %s, expires at %s", l.Host, l.Pid, l.StartTime, l.Expiry)
+}
+
+// 获取备份锁, 锁被其他任务持有且没有过期时退出, breaklock时强制删除已有的锁
+// 获取成功后定时续约, 任务结束时(包括异常退出)释放
+func AcquireBkLock(breaklock bool) {
+	s3client := CreS3Client()
+	lockForce = breaklock
+
+	current, etag, err := getlock(s3client)
+	if err != nil {
+		LogError("Failed to read backup lock(%s): %s", BkLockFile(), err.Error())
+		Exit(1)
+	}
+	if current != nil {
+		expiry, perr := time.Parse(time.RFC3339, current.Expiry)
+		if breaklock {
+			LogInfo("Breaking backup lock held by %s", current)
+		} else if perr == nil && time.Now().After(expiry) {
+			LogInfo("Taking over expired backup lock held by %s", current)
+		} else {
+			LogError("Another backup, prune or synthesize job is writing to %s (%s), use --break-lock if it is stale", ArgConfig.S3Folder, current)
+			Exit(1)
+		}
+	}
+
+	token := make([]byte, 8)
+	rand.Read(token)
+	host, _ := os.Hostname()
+	lock := &BkLock{
+		Owner:     hex.EncodeToString(token),
+		Host:      host,
+		Pid:       os.Getpid(),
+		StartTime: time.Now().Format(time.RFC3339),
+	}
+	if current == nil {
+		etag = ""
+	}
+	etag, err = putlock(s3client, lock, etag)
+	if err != nil {
+		LogError("Failed to take backup lock(%s): %s", BkLockFile(), err.Error())
+		Exit(1)
+	}
+	LogInfo("Took backup lock %s", BkLockFile())
+
+	lockMu.Lock()
+	heldLock, lockETag = lock, etag
+	lockMu.Unlock()
+
+	OnExit(func(code int) {
+		ReleaseBkLock()
+	})
+	go renewlock()
+}
+
+// 定时续约, 锁被其他任务拿走时退出, 避免两个任务同时写入
+func renewlock() {
+	defer Recover()
+	ticker := time.NewTicker(lockRenew)
+	defer ticker.Stop()
+	for range ticker.C {
+		lockMu.Lock()
+		if heldLock == nil {
+			lockMu.Unlock()
+			return
+		}
+		s3client := CreS3Client()
+		owner := heldLock.Owner
+		etag, err := putlock(s3client, heldLock, lockETag)
+		if err == nil {
+			lockETag = etag
+			lockMu.Unlock()
+			continue
+		}
+		lockMu.Unlock()
+
+		// 网络错误时下次重试, 锁已经属于其他任务时退出
+		current, _, gerr := getlock(s3client)
+		if gerr == nil && (current == nil || current.Owner != owner) {
+			LogError("Backup lock(%s) was lost, stopping the job", BkLockFile())
+			Exit(1)
+		}
+		LogInfo("Failed to renew backup lock(%s): %s", BkLockFile(), err.Error())
+	}
+}
+
+// 释放备份锁, 只删除自己持有的锁
+func ReleaseBkLock() {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	if heldLock == nil {
+		return
+	}
+
+	defer func() { heldLock = nil }()
+
+	s3client := CreS3Client()
+	current, _, err := getlock(s3client)
+	if err == nil && (current == nil || current.Owner != heldLock.Owner) {
+		LogInfo("Backup lock(%s) is no longer held by this job", BkLockFile())
+		return
+	}
+	if err == nil {
+		err = s3client.RemoveObject(context.Background(), ArgConfig.S3Bucket, BkLockFile(), minio.RemoveObjectOptions{})
+	}
+	if err != nil {
+		LogInfo("Failed to release backup lock(%s): %s", BkLockFile(), err.Error())
+	} else {
+		LogInfo("Released backup lock %s", BkLockFile())
+	}
+}
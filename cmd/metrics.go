@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 指标的一个采样
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// 一个指标, 都按gauge类型输出
+type metricFamily struct {
+	help    string
+	samples map[string]metricSample
+}
+
+var (
+	metricMu    sync.Mutex
+	metrics     = make(map[string]*metricFamily)
+	jobStart    time.Time
+	jobSuccess  = true
+	metricsUsed bool
+)
+
+// 设置指标的值, 标签中总是带上任务类型和数据库名
+func SetMetric(name string, help string, labels map[string]string, value float64) {
+	metricMu.Lock()
+	defer metricMu.Unlock()
+
+	family, ok := metrics[name]
+	if !ok {
+		family = &metricFamily{help: help, samples: make(map[string]metricSample)}
+		metrics[name] = family
+	}
+
+	all := map[string]string{"job": ArgConfig.Type, "db": ArgConfig.DbName}
+	for k, v := range labels {
+		all[k] = v
+	}
+	var keys []string
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(all[k])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, value))
+	}
+	labelstr := "{" + strings.Join(pairs, ",") + "}"
+	family.samples[labelstr] = metricSample{labels: labelstr, value: value}
+}
+
+// 标记任务结果, 任务正常结束但有失败的表时设置为false
+func SetJobSuccess(success bool) {
+	metricMu.Lock()
+	defer metricMu.Unlock()
+	jobSuccess = success
+}
+
+// 是否输出监控指标
+func MetricsEnabled() bool {
+	return metricsUsed
+}
+
+// 设置备份集时间戳对应的时间指标, 距今的时间由prometheus中的 time() - 指标 计算
+func SetSetTimeMetric(name string, help string, ts string) {
+	settime, err := ParseBkTime(ts)
+	if err != nil {
+		return
+	}
+	SetMetric(name+"_timestamp_seconds", help+", unix time", nil, float64(settime.Unix()))
+}
+
+// 按prometheus文本格式输出所有指标
+func writemetrics(w io.Writer) {
+	metricMu.Lock()
+	defer metricMu.Unlock()
+
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := metrics[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, family.help, name)
+		var labels []string
+		for labelstr := range family.samples {
+			labels = append(labels, labelstr)
+		}
+		sort.Strings(labels)
+		for _, labelstr := range labels {
+			fmt.Fprintf(w, "%s%s %v\n", name, labelstr, family.samples[labelstr].value)
+		}
+	}
+}
+
+// 写入node_exporter的textfile, 先写临时文件再改名, 避免读到一半的文件
+func flushmetrics() {
+	if ArgConfig.MetricsFile == "" {
+		return
+	}
+	tmpfile := filepath.Join(filepath.Dir(ArgConfig.MetricsFile), "."+filepath.Base(ArgConfig.MetricsFile)+".tmp")
+	file, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		LogError("Failed to write metrics file(%s): %s", tmpfile, err.Error())
+		return
+	}
+	writemetrics(file)
+	file.Close()
+	if err := os.Rename(tmpfile, ArgConfig.MetricsFile); err != nil {
+		LogError("Failed to write metrics file(%s): %s", ArgConfig.MetricsFile, err.Error())
+	}
+}
+
+// 任务开始时输出运行中的状态, 任务退出时输出最终状态
+func StartMetrics() {
+	if ArgConfig.MetricsFile == "" && ArgConfig.MetricsListen == "" {
+		return
+	}
+	metricsUsed = true
+	jobStart = time.Now()
+	SetMetric("gpdbbr_job_start_timestamp_seconds", "Start time of the job, unix time", nil, float64(jobStart.Unix()))
+	SetMetric("gpdbbr_job_running", "Whether the job is running", nil, 1)
+	SetMetric("gpdbbr_job_success", "Whether the job finished successfully", nil, 0)
+	flushmetrics()
+	OnExit(func(code int) {
+		if code != 0 {
+			SetJobSuccess(false)
+		}
+		FinishMetrics()
+	})
+
+	if ArgConfig.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			SetMetric("gpdbbr_job_duration_seconds", "Duration of the job", nil, time.Since(jobStart).Seconds())
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			writemetrics(w)
+		})
+		go func() {
+			defer Recover()
+			if err := http.ListenAndServe(ArgConfig.MetricsListen, mux); err != nil {
+				LogError("Failed to start metrics listener on %s: %s", ArgConfig.MetricsListen, err.Error())
+			}
+		}()
+		LogInfo("Serving metrics on %s/metrics", ArgConfig.MetricsListen)
+	}
+}
+
+// 任务结束时输出最终状态
+func FinishMetrics() {
+	if !metricsUsed {
+		return
+	}
+	metricMu.Lock()
+	success := jobSuccess
+	metricMu.Unlock()
+
+	SetMetric("gpdbbr_job_running", "Whether the job is running", nil, 0)
+	if success {
+		SetMetric("gpdbbr_job_success", "Whether the job finished successfully", nil, 1)
+	}
+	SetMetric("gpdbbr_job_duration_seconds", "Duration of the job", nil, time.Since(jobStart).Seconds())
+	flushmetrics()
+}
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// 任务完成通知的内容
+type Notification struct {
+	Job        string          `json:"job"`
+	DBName     string          `json:"dbname"`
+	Host       string          `json:"host"`
+	Timestamp  string          `json:"timestamp"`
+	Status     string          `json:"status"` // success, warning 或 failed
+	Message    string          `json:"message,omitempty"`
+	FailTables []string        `json:"failtables"`
+	FailDDLs   []string        `json:"failddls"`
+	RowCheck   *RowCheckResult `json:"rowcheck,omitempty"`
+}
+
+// 行数校验的差异
+type RowCheckResult struct {
+	OnlyBackup []string `json:"onlybackup"`
+	OnlyDb     []string `json:"onlydb"`
+	DiffRows   []string `json:"diffrows"`
+}
+
+var (
+	notifyMu  sync.Mutex
+	notified  bool
+	lastError string
+)
+
+// 记录最后一条错误日志, 异常退出时放到通知中
+func setlasterror(message string) {
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+	lastError = message
+}
+
+// 发送任务完成通知, 未指定--notify-url时不发送, 发送失败不影响任务结果
+func Notify(n Notification) {
+	notifyMu.Lock()
+	if ArgConfig.NotifyUrl == "" || notified {
+		notifyMu.Unlock()
+		return
+	}
+	notified = true
+	notifyMu.Unlock()
+
+	n.Job = ArgConfig.Type
+	n.DBName = ArgConfig.DbName
+	n.Host, _ = os.Hostname()
+	if n.FailTables == nil {
+		n.FailTables = []string{}
+	}
+	if n.FailDDLs == nil {
+		n.FailDDLs = []string{}
+	}
+
+	body, err := notifybody(n)
+	if err != nil {
+		LogError("Failed to build notification: %s", err.Error())
+		return
+	}
+
+	err = postnotify(body)
+	if err != nil {
+		LogError("Failed to send notification to %s: %s", ArgConfig.NotifyUrl, err.Error())
+		return
+	}
+	LogInfo("Sent %s notification to %s", n.Status, ArgConfig.NotifyUrl)
+}
+
+// 异常退出时发送失败通知, 只有backup, restore和check任务发送通知
+func NotifyFailed(code int) {
+	if code == 0 || (ArgConfig.Type != "backup" && ArgConfig.Type != "restore" && ArgConfig.Type != "check") {
+		return
+	}
+
+	notifyMu.Lock()
+	message := lastError
+	notifyMu.Unlock()
+	logMu.Lock()
+	ts := logBkTime
+	logMu.Unlock()
+
+	Notify(Notification{Timestamp: ts, Status: "failed", Message: message})
+}
+
+// 生成通知内容, 指定了模板时使用模板, 模板的结果必须是json
+func notifybody(n Notification) ([]byte, error) {
+	if ArgConfig.NotifyTemplate == "" {
+		return json.Marshal(n)
+	}
+
+	tmpl, err := ParseNotifyTemplate(ArgConfig.NotifyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template %s does not produce valid json", ArgConfig.NotifyTemplate)
+	}
+	return buf.Bytes(), nil
+}
+
+// 解析通知模板, 模板中可以使用 json 函数输出json格式的值
+func ParseNotifyTemplate(file string) (*template.Template, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("notify").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(string(data))
+}
+
+// 读取签名密钥, 密钥文件优先, 其次是环境变量
+func LoadNotifySecret(file string) (string, error) {
+	if file == "" {
+		return os.Getenv("GPDBBR_NOTIFY_SECRET"), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// 发送通知, 网络错误和5xx, 429时按 1s, 2s, 4s ... 重试
+func postnotify(body []byte) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	var err error
+	for attempt := 0; attempt <= ArgConfig.NotifyRetries; attempt++ {
+		if attempt > 0 {
+			LogInfo("Retrying notification in %d seconds: %s", 1<<(attempt-1), err.Error())
+			time.Sleep(time.Duration(1<<(attempt-1)) * time.Second)
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, ArgConfig.NotifyUrl, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "gpdbbr")
+		// 签名为请求体的 HMAC-SHA256
+		if ArgConfig.NotifySecret != "" {
+			mac := hmac.New(sha256.New, []byte(ArgConfig.NotifySecret))
+			mac.Write(body)
+			req.Header.Set("X-Gpdbbr-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("http status %s", resp.Status)
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return err
+		}
+	}
+	return err
+}
@@ -6,47 +6,210 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
+// 可以重复指定或者逗号分隔的参数
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
 func customUsage() {
 	fmt.Fprintf(os.Stderr, "Usage: gpdbbr [OPTIONS]\n\n")
 	fmt.Fprintf(os.Stderr, "Options:\n")
-	fmt.Fprintf(os.Stderr, "  --type string          Command type, backup, restore or check (required)\n")
-	fmt.Fprintf(os.Stderr, "  --dbname string        Database name (required)\n")
+	fmt.Fprintf(os.Stderr, "  --config string        YAML file with options named like the flags, ${VAR} is read from the environment,\n")
+	fmt.Fprintf(os.Stderr, "                         flags override the file, mode must be 0600 or less (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --type string          Command type, backup, restore, check, list, prune, synthesize or verify (required)\n")
+	fmt.Fprintf(os.Stderr, "  --dbname string        Database name (required, optional for list and verify)\n")
+	fmt.Fprintf(os.Stderr, "  --dbhost string        Database host, or set PGHOST (optional, default: localhost)\n")
+	fmt.Fprintf(os.Stderr, "  --dbport int           Database port, or set PGPORT (optional, default: 5432)\n")
+	fmt.Fprintf(os.Stderr, "  --dbuser string        Database user, or set PGUSER, password is read from PGPASSWORD or .pgpass (optional, default: gpadmin)\n")
+	fmt.Fprintf(os.Stderr, "  --ssh-user string      SSH user to segment hosts, for backup and restore it must own the segment data directories (optional, default: gpadmin)\n")
+	fmt.Fprintf(os.Stderr, "  --ssh-port int         SSH port of segment hosts (optional, default: 22)\n")
+	fmt.Fprintf(os.Stderr, "  --ssh-key-file list    SSH private key files (optional, default: ~/.ssh/id_ed25519, id_ecdsa and id_rsa)\n")
+	fmt.Fprintf(os.Stderr, "  --ssh-no-agent         Do not use ssh-agent from SSH_AUTH_SOCK (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --ssh-known-hosts string\n")
+	fmt.Fprintf(os.Stderr, "                         known_hosts file to verify host keys (optional, default: ~/.ssh/known_hosts)\n")
+	fmt.Fprintf(os.Stderr, "  --ssh-insecure-ignore-host-key\n")
+	fmt.Fprintf(os.Stderr, "                         Do not verify host keys (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --ssh-keepalive int    Seconds between ssh keepalives, 0 to disable (optional, default: 30)\n")
 	fmt.Fprintf(os.Stderr, "  --jobs int             Parallel jobs [1-64] (optional, default: 1)\n")
 	fmt.Fprintf(os.Stderr, "  --s3endpoint string    S3 endpoint (required)\n")
 	fmt.Fprintf(os.Stderr, "  --s3id string          S3 access key ID (required)\n")
 	fmt.Fprintf(os.Stderr, "  --s3key string         S3 access key (required)\n")
 	fmt.Fprintf(os.Stderr, "  --s3bucket string      S3 bucket name (required)\n")
-	fmt.Fprintf(os.Stderr, "  --s3folder string      S3 folder name (required)\n\n")
+	fmt.Fprintf(os.Stderr, "  --s3folder string      S3 folder name (required)\n")
+	fmt.Fprintf(os.Stderr, "  --s3-tls               Connect to s3 with https, also set by an https:// s3endpoint (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --s3-ca-file string    CA bundle to verify the s3 certificate, copied to all hosts for the plugin (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --s3-insecure-skip-verify\n")
+	fmt.Fprintf(os.Stderr, "                         Do not verify the s3 certificate, not supported by backup and restore (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --s3-region string     S3 region (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --s3-bucket-lookup string\n")
+	fmt.Fprintf(os.Stderr, "                         Bucket lookup style, auto, dns or path, dns is not supported by backup and restore (optional, default: auto)\n")
+	fmt.Fprintf(os.Stderr, "  --s3-session-token string\n")
+	fmt.Fprintf(os.Stderr, "                         S3 session token, or set GPDBBR_S3_SESSION_TOKEN, not supported by backup and restore (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --json                 Print list result or backup plan as json (optional, list or backup --dry-run)\n")
+	fmt.Fprintf(os.Stderr, "  --keep-days int        Keep backup sets taken in the last N days (prune only)\n")
+	fmt.Fprintf(os.Stderr, "  --keep-last int        Keep the last N backup sets (prune only)\n")
+	fmt.Fprintf(os.Stderr, "  --keep-fulls int       Keep the last N full backups and their incrementals (prune only)\n")
+	fmt.Fprintf(os.Stderr, "  --ignore-standby list  Standby hosts not to keep backup sets for, e.g. decommissioned ones (optional, prune only)\n")
+	fmt.Fprintf(os.Stderr, "  --standby-max-age int  Ignore standbys that have not reported for N days, 0 to never ignore (optional, prune only)\n")
+	fmt.Fprintf(os.Stderr, "                         A standby is protected after its first restore, a new standby restores from the newest\n")
+	fmt.Fprintf(os.Stderr, "                         full backup, which is always kept, use --keep-fulls 2 while it restores\n")
+	fmt.Fprintf(os.Stderr, "  --dry-run              Print the plan without changing anything (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --full                 Force a full backup and start a new backup chain (optional, backup only)\n")
+	fmt.Fprintf(os.Stderr, "  --include-schema list  Only back up or check these schemas, comma separated or repeated (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --exclude-schema list  Skip these schemas, comma separated or repeated (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --include-table list   Only back up or check these tables (schema.table), comma separated or repeated (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --exclude-table list   Skip these tables (schema.table), comma separated or repeated (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --table-file string    File with one schema.table per line to include (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --resume string        Resume an interrupted backup by its timestamp (optional, backup only)\n")
+	fmt.Fprintf(os.Stderr, "  --break-lock           Remove a stale backup lock left by another job, or write the lock on s3 without conditional writes (optional, backup, prune and synthesize)\n")
+	fmt.Fprintf(os.Stderr, "  --timestamp string     Only verify the backup with this timestamp (optional, verify only)\n")
+	fmt.Fprintf(os.Stderr, "  --deep                 Also download, decrypt and decompress every data file (optional, verify only)\n")
+	fmt.Fprintf(os.Stderr, "  --workdir string       Directory for local metadata files (optional, default: /tmp)\n")
+	fmt.Fprintf(os.Stderr, "  --keep-local           Keep local metadata files after upload, for debugging (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --log-file string      Append JSON lines logs to this file (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --metrics-file string  Write prometheus metrics to this node_exporter textfile, e.g. gpdbbr.prom (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --metrics-listen string\n")
+	fmt.Fprintf(os.Stderr, "                         Serve prometheus metrics on this address at /metrics while the job runs, e.g. :9187 (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --notify-url string    POST a JSON notification to this url when backup, restore or check finishes (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --notify-retries int   Retries of a failed notification (optional, default: 3)\n")
+	fmt.Fprintf(os.Stderr, "  --notify-secret-file string\n")
+	fmt.Fprintf(os.Stderr, "                         Sign the notification with HMAC-SHA256 in X-Gpdbbr-Signature, or set GPDBBR_NOTIFY_SECRET (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --notify-template string\n")
+	fmt.Fprintf(os.Stderr, "                         Go text/template file rendering the JSON payload (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --heap-detector string Heap table change detector, stat, counter or pgstatfile (optional, default: stat)\n")
+	fmt.Fprintf(os.Stderr, "  --compression string   Table data codec, gzip[:1-9], zstd[:1-19], lz4 or none (optional, default: gzip:1)\n")
+	fmt.Fprintf(os.Stderr, "  --encrypt-key-file string\n")
+	fmt.Fprintf(os.Stderr, "                         AES-256 key file, 32 bytes or 64 hex characters (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --encrypt-passphrase-file string\n")
+	fmt.Fprintf(os.Stderr, "                         Passphrase file to derive the key from, or set GPDBBR_ENCRYPT_PASSPHRASE (optional)\n")
+	fmt.Fprintf(os.Stderr, "  --insert-only-table list\n")
+	fmt.Fprintf(os.Stderr, "                         Heap tables (schema.table) only receiving inserts, back up new rows only (optional)\n")
+	fmt.Fprintf(os.Stderr, "                         Tables with 'gpdbbr:insert-only' in the comment are insert-only too\n\n")
 	fmt.Fprintf(os.Stderr, "Example:\n")
 	fmt.Fprintf(os.Stderr, "  gpdbbr --type backup --dbname chenxw --jobs 2 --s3endpoint '10.187.112.1:1521' --s3id admin --s3key password --s3bucket test --s3folder chenxw\n")
+	fmt.Fprintf(os.Stderr, "  gpdbbr --config /home/gpadmin/gpdbbr.yaml --type backup\n\n")
+	fmt.Fprintf(os.Stderr, "Config file:\n")
+	fmt.Fprintf(os.Stderr, "  dbname: chenxw\n")
+	fmt.Fprintf(os.Stderr, "  s3endpoint: 10.187.112.1:1521\n")
+	fmt.Fprintf(os.Stderr, "  s3id: admin\n")
+	fmt.Fprintf(os.Stderr, "  s3key: ${S3_SECRET_KEY}\n")
+	fmt.Fprintf(os.Stderr, "  s3bucket: test\n")
+	fmt.Fprintf(os.Stderr, "  s3folder: chenxw\n")
+	fmt.Fprintf(os.Stderr, "  exclude-schema: [tmp, stage]\n")
+	fmt.Fprintf(os.Stderr, "  tables:\n")
+	fmt.Fprintf(os.Stderr, "    - table: public.big_log\n")
+	fmt.Fprintf(os.Stderr, "      compression: zstd:9\n")
+	fmt.Fprintf(os.Stderr, "    - table: public.scratch\n")
+	fmt.Fprintf(os.Stderr, "      exclude: true\n")
 }
 
 func ParseArg() {
-	cmdType := flag.String("type", "", "command type, backup, restore or check (required)")
-	dbname := flag.String("dbname", "", "database name (required)")
+	configfile := flag.String("config", "", "YAML file with options named like the flags, flags override the file (optional)")
+	cmdType := flag.String("type", "", "command type, backup, restore, check, list, prune, synthesize or verify (required)")
+	dbname := flag.String("dbname", "", "database name (required, optional for list and verify)")
+	dbhost := flag.String("dbhost", "", "database host, or set PGHOST (optional, default: localhost)")
+	dbport := flag.Int("dbport", 0, "database port, or set PGPORT (optional, default: 5432)")
+	dbuser := flag.String("dbuser", "", "database user, or set PGUSER (optional, default: gpadmin)")
+	sshuser := flag.String("ssh-user", "gpadmin", "ssh user to segment hosts, for backup and restore it must own the segment data directories (optional, default: gpadmin)")
+	sshport := flag.Int("ssh-port", 22, "ssh port of segment hosts (optional, default: 22)")
+	var sshkeyfiles listFlag
+	flag.Var(&sshkeyfiles, "ssh-key-file", "ssh private key files (optional)")
+	sshnoagent := flag.Bool("ssh-no-agent", false, "do not use ssh-agent (optional)")
+	sshknownhosts := flag.String("ssh-known-hosts", os.Getenv("HOME")+"/.ssh/known_hosts", "known_hosts file to verify host keys (optional)")
+	sshignorehostkey := flag.Bool("ssh-insecure-ignore-host-key", false, "do not verify host keys (optional)")
+	sshkeepalive := flag.Int("ssh-keepalive", 30, "seconds between ssh keepalives, 0 to disable (optional, default: 30)")
 	jobs := flag.Int("jobs", 1, "parallel jobs [1-64] (optional, default: 1)")
 	s3endpoint := flag.String("s3endpoint", "", "s3 endpoint (required)")
 	s3id := flag.String("s3id", "", "s3 access key id (required)")
 	s3key := flag.String("s3key", "", "s3 access key (required)")
 	s3bucket := flag.String("s3bucket", "", "s3 bucket name (required)")
 	s3folder := flag.String("s3folder", "", "s3 folder name (required)")
+	s3tls := flag.Bool("s3-tls", false, "connect to s3 with https (optional)")
+	s3cafile := flag.String("s3-ca-file", "", "CA bundle to verify the s3 certificate (optional)")
+	s3skipverify := flag.Bool("s3-insecure-skip-verify", false, "do not verify the s3 certificate (optional)")
+	s3region := flag.String("s3-region", "", "s3 region (optional)")
+	s3bucketlookup := flag.String("s3-bucket-lookup", "auto", "bucket lookup style, auto, dns or path (optional, default: auto)")
+	s3sessiontoken := flag.String("s3-session-token", "", "s3 session token, or set GPDBBR_S3_SESSION_TOKEN (optional)")
+	jsonout := flag.Bool("json", false, "print list result or backup plan as json (optional, list or backup --dry-run)")
+	keepdays := flag.Int("keep-days", 0, "keep backup sets taken in the last N days (prune only)")
+	keeplast := flag.Int("keep-last", 0, "keep the last N backup sets (prune only)")
+	keepfulls := flag.Int("keep-fulls", 0, "keep the last N full backups and their incrementals (prune only)")
+	var ignorestandby listFlag
+	flag.Var(&ignorestandby, "ignore-standby", "standby hosts not to keep backup sets for (optional, prune only)")
+	standbymaxage := flag.Int("standby-max-age", 0, "ignore standbys that have not reported for N days, 0 to never ignore (optional, prune only)")
+	dryrun := flag.Bool("dry-run", false, "print the plan without changing anything (optional)")
+	full := flag.Bool("full", false, "force a full backup and start a new backup chain (optional, backup only)")
+	var includeschema, excludeschema, includetable, excludetable, insertonly listFlag
+	flag.Var(&includeschema, "include-schema", "only back up or check these schemas (optional)")
+	flag.Var(&excludeschema, "exclude-schema", "skip these schemas (optional)")
+	flag.Var(&includetable, "include-table", "only back up or check these tables, schema.table (optional)")
+	flag.Var(&excludetable, "exclude-table", "skip these tables, schema.table (optional)")
+	tablefile := flag.String("table-file", "", "file with one schema.table per line to include (optional)")
+	flag.Var(&insertonly, "insert-only-table", "heap tables only receiving inserts, schema.table (optional)")
+	resume := flag.String("resume", "", "resume an interrupted backup by its timestamp (optional, backup only)")
+	breaklock := flag.Bool("break-lock", false, "remove a stale backup lock left by another job, or write the lock on s3 without conditional writes (optional, backup, prune and synthesize)")
+	timestamp := flag.String("timestamp", "", "only verify the backup with this timestamp (optional, verify only)")
+	deep := flag.Bool("deep", false, "also download, decrypt and decompress every data file (optional, verify only)")
+	workdir := flag.String("workdir", "/tmp", "directory for local metadata files (optional, default: /tmp)")
+	keeplocal := flag.Bool("keep-local", false, "keep local metadata files after upload, for debugging (optional)")
+	logfile := flag.String("log-file", "", "append JSON lines logs to this file (optional)")
+	metricsfile := flag.String("metrics-file", "", "write prometheus metrics to this node_exporter textfile (optional)")
+	metricslisten := flag.String("metrics-listen", "", "serve prometheus metrics on this address at /metrics while the job runs (optional)")
+	notifyurl := flag.String("notify-url", "", "POST a JSON notification to this url when backup, restore or check finishes (optional)")
+	notifyretries := flag.Int("notify-retries", 3, "retries of a failed notification (optional, default: 3)")
+	notifysecretfile := flag.String("notify-secret-file", "", "sign the notification with HMAC-SHA256, or set GPDBBR_NOTIFY_SECRET (optional)")
+	notifytemplate := flag.String("notify-template", "", "go text/template file rendering the JSON payload (optional)")
+	heapdetector := flag.String("heap-detector", "stat", "heap table change detector, stat, counter or pgstatfile (optional, default: stat)")
+	compression := flag.String("compression", DefaultCompression, "table data codec, gzip[:1-9], zstd[:1-19], lz4 or none (optional, default: gzip:1)")
+	keyfile := flag.String("encrypt-key-file", "", "AES-256 key file, 32 bytes or 64 hex characters (optional)")
+	passfile := flag.String("encrypt-passphrase-file", "", "passphrase file to derive the key from, or set GPDBBR_ENCRYPT_PASSPHRASE (optional)")
 
 	flag.Usage = customUsage
 	flag.Parse()
 
+	// 读取配置文件, 命令行中指定的参数不会被覆盖
+	var policies []TablePolicy
+	if *configfile != "" {
+		setflags := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			setflags[f.Name] = true
+		})
+		var err error
+		policies, err = LoadConfigFile(*configfile, setflags)
+		if err != nil {
+			log.Printf("Error: Failed to load config file(%s): %s\n", *configfile, err.Error())
+			os.Exit(1)
+		}
+	}
+
 	if *cmdType == "" {
 		log.Printf("Error: Missing required argument: --type\n")
 		flag.Usage()
 		os.Exit(1)
-	} else if *cmdType != "backup" && *cmdType != "restore" && *cmdType != "check" {
-		log.Printf("Error: Invalid argument: --type, must be backup, restore or check\n")
+	} else if *cmdType != "backup" && *cmdType != "restore" && *cmdType != "check" && *cmdType != "list" && *cmdType != "prune" && *cmdType != "synthesize" && *cmdType != "verify" {
+		log.Printf("Error: Invalid argument: --type, must be backup, restore, check, list, prune, synthesize or verify\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if *dbname == "" {
+	// list和verify只读取s3, 不连接数据库
+	if *dbname == "" && *cmdType != "list" && *cmdType != "verify" {
 		log.Printf("Error: Missing required argument: --dbname\n")
 		flag.Usage()
 		os.Exit(1)
@@ -82,6 +245,203 @@ func ParseArg() {
 		os.Exit(1)
 	}
 
+	// s3地址中带有协议时, 由协议决定是否使用https
+	if strings.HasPrefix(*s3endpoint, "https://") {
+		*s3tls = true
+	}
+	*s3endpoint = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(*s3endpoint, "https://"), "http://"), "/")
+
+	if *s3bucketlookup != "auto" && *s3bucketlookup != "dns" && *s3bucketlookup != "path" {
+		log.Printf("Error: Invalid argument: --s3-bucket-lookup, must be auto, dns or path\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (*s3cafile != "" || *s3skipverify) && !*s3tls {
+		log.Printf("Error: --s3-ca-file and --s3-insecure-skip-verify require --s3-tls\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *s3sessiontoken == "" {
+		*s3sessiontoken = os.Getenv("GPDBBR_S3_SESSION_TOKEN")
+	}
+
+	// gpbackup_s3_plugin只支持静态凭证和CA证书, 备份和还原时不能使用临时凭证和跳过证书校验
+	if (*cmdType == "backup" || *cmdType == "restore") && (*s3sessiontoken != "" || *s3skipverify) {
+		log.Printf("Error: --s3-session-token and --s3-insecure-skip-verify are not supported by gpbackup_s3_plugin, cannot be used with %s\n", *cmdType)
+		os.Exit(1)
+	}
+
+	// gpbackup_s3_plugin按path方式访问bucket, 备份和还原时不能使用dns方式, 否则segment上的COPY和本程序访问方式不一致
+	if (*cmdType == "backup" || *cmdType == "restore") && *s3bucketlookup == "dns" {
+		log.Printf("Error: --s3-bucket-lookup dns is not supported by gpbackup_s3_plugin, cannot be used with %s\n", *cmdType)
+		os.Exit(1)
+	}
+
+	// 数据库连接, 命令行参数优先, 其次是PG环境变量
+	if *dbhost == "" {
+		*dbhost = envdefault("PGHOST", "localhost")
+	}
+	if *dbport == 0 {
+		port, err := strconv.Atoi(envdefault("PGPORT", "5432"))
+		if err != nil {
+			log.Printf("Error: Invalid environment variable PGPORT: %s\n", os.Getenv("PGPORT"))
+			os.Exit(1)
+		}
+		*dbport = port
+	}
+	if *dbport < 1 || *dbport > 65535 {
+		log.Printf("Error: dbport must be in range [1-65535]\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *dbuser == "" {
+		*dbuser = envdefault("PGUSER", "gpadmin")
+	}
+	dbsslmode := envdefault("PGSSLMODE", "disable")
+
+	if *sshport < 1 || *sshport > 65535 {
+		log.Printf("Error: ssh-port must be in range [1-65535]\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *sshkeepalive < 0 {
+		log.Printf("Error: ssh-keepalive must not be negative\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *keepdays < 0 || *keeplast < 0 || *keepfulls < 0 || *standbymaxage < 0 {
+		log.Printf("Error: keep-days, keep-last, keep-fulls and standby-max-age must not be negative\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *cmdType == "prune" && *keepdays == 0 && *keeplast == 0 && *keepfulls == 0 {
+		log.Printf("Error: Missing required argument: --keep-days, --keep-last or --keep-fulls\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *tablefile != "" {
+		data, err := os.ReadFile(*tablefile)
+		if err != nil {
+			log.Printf("Error: Failed to read table file(%s): %s\n", *tablefile, err.Error())
+			os.Exit(1)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				includetable = append(includetable, line)
+			}
+		}
+	}
+
+	// 表级别策略
+	for i, policy := range policies {
+		if !strings.Contains(policy.Table, ".") {
+			log.Printf("Error: Invalid table name %s in config file, must be schema.table\n", policy.Table)
+			os.Exit(1)
+		}
+		if policy.Exclude {
+			excludetable = append(excludetable, policy.Table)
+		}
+		if policy.Compression != "" {
+			codec, err := ParseCompression(policy.Compression)
+			if err != nil {
+				log.Printf("Error: Invalid compression of table %s in config file, %s\n", policy.Table, err.Error())
+				os.Exit(1)
+			}
+			policies[i].Compression = codec
+		}
+	}
+
+	for _, table := range append(append(append([]string{}, includetable...), excludetable...), insertonly...) {
+		if !strings.Contains(table, ".") {
+			log.Printf("Error: Invalid table name %s, must be schema.table\n", table)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if *resume != "" {
+		if _, err := strconv.Atoi(*resume); err != nil || len(*resume) != 17 {
+			log.Printf("Error: Invalid argument: --resume, must be a 17 digit backup timestamp\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if *dryrun && *resume != "" {
+		log.Printf("Error: --dry-run cannot be used with --resume\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *timestamp != "" {
+		if _, err := strconv.Atoi(*timestamp); err != nil || len(*timestamp) != 17 {
+			log.Printf("Error: Invalid argument: --timestamp, must be a 17 digit backup timestamp\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if *heapdetector != "stat" && *heapdetector != "counter" && *heapdetector != "pgstatfile" {
+		log.Printf("Error: Invalid argument: --heap-detector, must be stat, counter or pgstatfile\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	codec, err := ParseCompression(*compression)
+	if err != nil {
+		log.Printf("Error: Invalid argument: --compression, %s\n", err.Error())
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *keyfile != "" && *passfile != "" {
+		log.Printf("Error: --encrypt-key-file and --encrypt-passphrase-file cannot be used together\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	err = LoadCryptKey(*keyfile, *passfile)
+	if err != nil {
+		log.Printf("Error: Failed to load encryption key: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if *notifyurl != "" && !strings.HasPrefix(*notifyurl, "http://") && !strings.HasPrefix(*notifyurl, "https://") {
+		log.Printf("Error: Invalid argument: --notify-url, must be an http or https url\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *notifyretries < 0 || *notifyretries > 10 {
+		log.Printf("Error: notify-retries must be in range [0-10]\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	notifysecret, err := LoadNotifySecret(*notifysecretfile)
+	if err != nil {
+		log.Printf("Error: Failed to read notify secret file: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if *notifytemplate != "" {
+		if _, err := ParseNotifyTemplate(*notifytemplate); err != nil {
+			log.Printf("Error: Failed to parse notify template: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if info, err := os.Stat(*workdir); err != nil || !info.IsDir() {
+		log.Printf("Error: Invalid argument: --workdir, %s is not a directory\n", *workdir)
+		os.Exit(1)
+	}
+
 	if *jobs < 1 || *jobs > 64 {
 		log.Printf("Error: jobs must be in range [1-64]\n")
 		flag.Usage()
@@ -89,14 +449,62 @@ func ParseArg() {
 	}
 
 	ArgConfig = Config{
-		Type:       *cmdType,
-		DbName:     *dbname,
-		Jobs:       *jobs,
-		S3Endpoint: *s3endpoint,
-		S3Id:       *s3id,
-		S3Key:      *s3key,
-		S3Bucket:   *s3bucket,
-		S3Folder:   *s3folder,
+		Type:             *cmdType,
+		DbName:           *dbname,
+		Jobs:             *jobs,
+		DbHost:           *dbhost,
+		DbPort:           *dbport,
+		DbUser:           *dbuser,
+		DbSSLMode:        dbsslmode,
+		SSHUser:          *sshuser,
+		SSHPort:          *sshport,
+		SSHKeyFiles:      sshkeyfiles,
+		SSHNoAgent:       *sshnoagent,
+		SSHKnownHosts:    *sshknownhosts,
+		SSHIgnoreHostKey: *sshignorehostkey,
+		SSHKeepAlive:     *sshkeepalive,
+		S3Endpoint:       *s3endpoint,
+		S3Id:             *s3id,
+		S3Key:            *s3key,
+		S3Bucket:         *s3bucket,
+		S3Folder:         *s3folder,
+		S3TLS:            *s3tls,
+		S3CAFile:         *s3cafile,
+		S3SkipVerify:     *s3skipverify,
+		S3Region:         *s3region,
+		S3BucketLookup:   *s3bucketlookup,
+		S3SessionToken:   *s3sessiontoken,
+		Json:             *jsonout,
+		KeepDays:         *keepdays,
+		KeepLast:         *keeplast,
+		KeepFulls:        *keepfulls,
+		IgnoreStandby:    ignorestandby,
+		StandbyMaxAge:    *standbymaxage,
+		DryRun:           *dryrun,
+		Full:             *full,
+		Resume:           *resume,
+		BreakLock:        *breaklock,
+		HeapDetector:     *heapdetector,
+		InsertOnly:       insertonly,
+		Compression:      codec,
+		Timestamp:        *timestamp,
+		Deep:             *deep,
+		LogFile:          *logfile,
+		WorkDir:          *workdir,
+		KeepLocal:        *keeplocal,
+		MetricsFile:      *metricsfile,
+		MetricsListen:    *metricslisten,
+		NotifyUrl:        *notifyurl,
+		NotifyRetries:    *notifyretries,
+		NotifySecret:     notifysecret,
+		NotifyTemplate:   *notifytemplate,
+		TablePolicies:    policies,
+		Filter: TableFilter{
+			IncludeSchema: includeschema,
+			ExcludeSchema: excludeschema,
+			IncludeTable:  includetable,
+			ExcludeTable:  excludetable,
+		},
 	}
 
 	// 打印软件版本
@@ -111,11 +519,19 @@ func ParseArg() {
 	exists, err := s3client.BucketExists(context.Background(), ArgConfig.S3Bucket)
 	if err != nil {
 		LogError("Failed to check s3 bucket exist: %s", err.Error())
-		os.Exit(1)
+		Exit(1)
 	}
 
 	if !exists {
 		LogError("The s3 bucket(%s) dest not exist", ArgConfig.S3Bucket)
-		os.Exit(1)
+		Exit(1)
+	}
+}
+
+// 读取环境变量, 未设置时使用默认值
+func envdefault(name string, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
 	}
+	return value
 }
@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"gopkg.in/yaml.v3"
+)
+
+// 备份集的s3目录前缀
+func BkSetPrefix(set BkSet) string {
+	return fmt.Sprintf("%s/backups/%s/%s/", ArgConfig.S3Folder, set.Date, set.Time)
+}
+
+// 备份集的jobinfo文件
+func BkSetMetaFile(set BkSet) string {
+	return fmt.Sprintf("%sgpdbbr_%s_jobinfo.yaml", BkSetPrefix(set), set.Time)
+}
+
+// 备份集的进度文件, 备份完成后删除
+func BkSetProgressFile(set BkSet) string {
+	return fmt.Sprintf("%sgpdbbr_%s_progress.yaml", BkSetPrefix(set), set.Time)
+}
+
+// 列出s3目录下的所有备份集, 按时间戳升序排列
+func ListBkSets(s3client *minio.Client) ([]BkSet, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var sets []BkSet
+	bkprefix := fmt.Sprintf("%s/backups/", ArgConfig.S3Folder)
+	datedirobjects := s3client.ListObjects(ctx, ArgConfig.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    bkprefix,
+		Recursive: false,
+	})
+
+	for datedir := range datedirobjects {
+		if datedir.Err != nil {
+			return nil, datedir.Err
+		}
+		datedirname := strings.TrimSuffix(strings.TrimPrefix(datedir.Key, bkprefix), "/")
+		if _, err := strconv.Atoi(datedirname); err != nil || len(datedirname) != 8 {
+			return nil, fmt.Errorf("the s3 contains unknown files: %s", datedir.Key)
+		}
+
+		dateprefix := fmt.Sprintf("%s%s/", bkprefix, datedirname)
+		timedirobjects := s3client.ListObjects(ctx, ArgConfig.S3Bucket, minio.ListObjectsOptions{
+			Prefix:    dateprefix,
+			Recursive: false,
+		})
+
+		for timedir := range timedirobjects {
+			if timedir.Err != nil {
+				return nil, timedir.Err
+			}
+			timedirname := strings.TrimSuffix(strings.TrimPrefix(timedir.Key, dateprefix), "/")
+			if _, err := strconv.Atoi(timedirname); err != nil || len(timedirname) != 17 {
+				return nil, fmt.Errorf("the s3 contains unknown files: %s", timedir.Key)
+			}
+			sets = append(sets, BkSet{Date: datedirname, Time: timedirname})
+		}
+	}
+
+	sort.Slice(sets, func(i, j int) bool {
+		if sets[i].Date != sets[j].Date {
+			return sets[i].Date < sets[j].Date
+		}
+		return sets[i].Time < sets[j].Time
+	})
+
+	return sets, nil
+}
+
+// 读取备份集的jobinfo文件
+func GetBkMeta(s3client *minio.Client, set BkSet) (BkMetaData, error) {
+	var bkmeta BkMetaData
+	err := GetS3Yaml(s3client, BkSetMetaFile(set), &bkmeta)
+	return bkmeta, err
+}
+
+// 读取s3上的yaml文件
+func GetS3Yaml(s3client *minio.Client, objectKey string, out interface{}) error {
+	object, err := s3client.GetObject(context.Background(), ArgConfig.S3Bucket, objectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	data, err := ioutil.ReadAll(object)
+	if err != nil {
+		return err
+	}
+
+	data, err = DecryptBytes(data)
+	if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(data, out)
+}
+
+// 判断s3错误是否为对象不存在
+func IsNoSuchKey(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// 备份集类型, 旧版本的jobinfo没有记录备份类型, 只有第一个备份集是全量备份
+func GetBkType(bkmeta BkMetaData, isfirst bool) string {
+	if bkmeta.JobInfo.BackupType != "" {
+		return bkmeta.JobInfo.BackupType
+	}
+	if isfirst {
+		return "full"
+	}
+	return "increment"
+}
+
+// 上传内存数据到s3
+func PutDataToS3(data []byte, objectKey string) {
+	s3client := CreS3Client()
+
+	data, err := EncryptBytes(data)
+	if err != nil {
+		LogError("Failed to encrypt object(%s): %s", objectKey, err.Error())
+		Exit(1)
+	}
+
+	_, err = s3client.PutObject(context.Background(), ArgConfig.S3Bucket, objectKey, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "application/octest-stream"})
+	if err != nil {
+		LogError("Failed to put object(%s) to s3: %s", objectKey, err.Error())
+		Exit(1)
+	}
+}
+
+// 列出备份集中的数据文件, 返回 文件id -> 各segment的对象信息
+func ListDataObjects(s3client *minio.Client, set BkSet) (map[string][]DataObject, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	setobjects := make(map[string][]DataObject)
+	prefix := BkSetPrefix(set) + "gpdbbr_"
+	objects := s3client.ListObjects(ctx, ArgConfig.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		// gpdbbr_<segid>_<timestamp>_<fileid>.<ext>
+		name, isdata := TrimDataFileExt(strings.TrimPrefix(object.Key, prefix))
+		parts := strings.Split(name, "_")
+		if !isdata || len(parts) != 3 || parts[1] != set.Time {
+			continue
+		}
+		setobjects[parts[2]] = append(setobjects[parts[2]], DataObject{
+			SegId: parts[0],
+			Size:  object.Size,
+			ETag:  strings.Trim(object.ETag, "\""),
+		})
+	}
+	for _, objs := range setobjects {
+		sort.Slice(objs, func(i, j int) bool {
+			a, _ := strconv.Atoi(objs[i].SegId)
+			b, _ := strconv.Atoi(objs[j].SegId)
+			return a < b
+		})
+	}
+	return setobjects, nil
+}
+
+// 备集群还原进度文件
+func StandbyFile(host string, dbname string) string {
+	return fmt.Sprintf("%s/standbys/%s_%s.yaml", ArgConfig.S3Folder, host, dbname)
+}
+
+// 列出所有备集群的还原进度
+func ListStandbys(s3client *minio.Client) ([]StandbyInfo, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var standbys []StandbyInfo
+	objects := s3client.ListObjects(ctx, ArgConfig.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    fmt.Sprintf("%s/standbys/", ArgConfig.S3Folder),
+		Recursive: true,
+	})
+
+	for object := range objects {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		standbyobject, err := s3client.GetObject(ctx, ArgConfig.S3Bucket, object.Key, minio.GetObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(standbyobject)
+		standbyobject.Close()
+		if err != nil {
+			return nil, err
+		}
+		data, err = DecryptBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt standby file(%s): %s", object.Key, err.Error())
+		}
+
+		var standby StandbyInfo
+		if err := yaml.Unmarshal(data, &standby); err != nil {
+			return nil, fmt.Errorf("failed to parse standby file(%s): %s", object.Key, err.Error())
+		}
+		standbys = append(standbys, standby)
+	}
+
+	return standbys, nil
+}
+
+// 解析17位的备份时间戳
+func ParseBkTime(ts string) (time.Time, error) {
+	if len(ts) < 14 {
+		return time.Time{}, fmt.Errorf("invalid backup timestamp %s", ts)
+	}
+	return time.ParseInLocation("20060102150405", ts[:14], time.Local)
+}
+
+// 服务端复制s3对象, 使用ComposeObject以支持超过5GB的对象
+func CopyS3Object(s3client *minio.Client, srcKey string, dstKey string) error {
+	_, err := s3client.ComposeObject(context.Background(),
+		minio.CopyDestOptions{Bucket: ArgConfig.S3Bucket, Object: dstKey},
+		minio.CopySrcOptions{Bucket: ArgConfig.S3Bucket, Object: srcKey})
+	return err
+}
+
+// 删除s3目录下的所有对象
+func RemoveS3Prefix(s3client *minio.Client, prefix string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objects := s3client.ListObjects(ctx, ArgConfig.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return object.Err
+		}
+		err := s3client.RemoveObject(ctx, ArgConfig.S3Bucket, object.Key, minio.RemoveObjectOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3地址, 插件需要带上协议
+func S3EndpointUrl() string {
+	if ArgConfig.S3TLS {
+		return fmt.Sprintf("https://%s", ArgConfig.S3Endpoint)
+	}
+	return fmt.Sprintf("http://%s", ArgConfig.S3Endpoint)
+}
+
+// segment上的CA证书文件
+func s3cabundle(ts string) string { return fmt.Sprintf("/tmp/gpdbbr_%s_ca.pem", ts) }
+
+// COPY管道中s3插件的环境变量, 指定了CA证书时插件使用下发的证书
+func S3PluginEnv(ts string) string {
+	if ArgConfig.S3CAFile == "" {
+		return ""
+	}
+	return fmt.Sprintf("AWS_CA_BUNDLE=%s ", s3cabundle(ts))
+}
+
+// bucket的访问方式
+func s3bucketlookup() minio.BucketLookupType {
+	switch ArgConfig.S3BucketLookup {
+	case "dns":
+		return minio.BucketLookupDNS
+	case "path":
+		return minio.BucketLookupPath
+	}
+	return minio.BucketLookupAuto
+}
+
+var (
+	s3TransportOnce sync.Once
+	s3Transport     *http.Transport
+	s3TransportErr  error
+)
+
+// s3客户端的http传输, 加载CA证书和是否跳过证书校验
+func s3transport() (*http.Transport, error) {
+	s3TransportOnce.Do(func() {
+		transport, err := minio.DefaultTransport(ArgConfig.S3TLS)
+		if err != nil {
+			s3TransportErr = err
+			return
+		}
+		if ArgConfig.S3TLS {
+			tlsconfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: ArgConfig.S3SkipVerify}
+			if ArgConfig.S3CAFile != "" {
+				pool, err := x509.SystemCertPool()
+				if err != nil {
+					pool = x509.NewCertPool()
+				}
+				pem, err := os.ReadFile(ArgConfig.S3CAFile)
+				if err != nil {
+					s3TransportErr = err
+					return
+				}
+				if !pool.AppendCertsFromPEM(pem) {
+					s3TransportErr = fmt.Errorf("no certificate found in ca file %s", ArgConfig.S3CAFile)
+					return
+				}
+				tlsconfig.RootCAs = pool
+			}
+			transport.TLSClientConfig = tlsconfig
+		}
+		s3Transport = transport
+	})
+	return s3Transport, s3TransportErr
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// 除了估算的大小外, 工作目录至少保留的空间
+const workDirMargin = 64 << 20
+
+// 本次任务的本地工作目录, <workdir>/gpdbbr_<timestamp>, 只有所有者可以访问
+var WorkDir string
+
+// 创建本次任务的工作目录, 任务结束时(包括异常退出)删除, 指定--keep-local时保留
+func InitWorkDir(ts string) {
+	WorkDir = filepath.Join(ArgConfig.WorkDir, "gpdbbr_"+ts)
+	err := os.MkdirAll(WorkDir, 0700)
+	if err == nil {
+		// 断点续传时目录可能已经存在
+		err = os.Chmod(WorkDir, 0700)
+	}
+	if err != nil {
+		LogError("Failed to create work directory(%s): %s", WorkDir, err.Error())
+		Exit(1)
+	}
+
+	OnExit(func(code int) {
+		if ArgConfig.KeepLocal {
+			LogInfo("Local files are kept in %s", WorkDir)
+			return
+		}
+		if err := os.RemoveAll(WorkDir); err != nil {
+			LogInfo("Failed to remove work directory(%s): %s", WorkDir, err.Error())
+		}
+	})
+}
+
+// 工作目录下的文件
+func WorkFile(name string) string {
+	return filepath.Join(WorkDir, name)
+}
+
+// 上传到s3后删除本地文件, 指定--keep-local时保留
+func RemoveWorkFile(path string) {
+	if ArgConfig.KeepLocal {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		LogInfo("Failed to remove local file(%s): %s", path, err.Error())
+	}
+}
+
+// 检查工作目录的剩余空间
+func CheckFreeSpace(need int64) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(WorkDir, &stat); err != nil {
+		return err
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	if free < need+workDirMargin {
+		return fmt.Errorf("work directory %s has %d MB free, at least %d MB is needed, use --workdir to choose another directory",
+			WorkDir, free>>20, (need+workDirMargin)>>20)
+	}
+	return nil
+}
+
+// s3上对象的大小, 用于估算本地文件需要的空间, 对象不存在时为0
+func S3ObjectSize(objectKey string) int64 {
+	info, err := CreS3Client().StatObject(context.Background(), ArgConfig.S3Bucket, objectKey, minio.StatObjectOptions{})
+	if err != nil {
+		return 0
+	}
+	return info.Size
+}
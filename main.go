@@ -2,34 +2,57 @@ package main
 
 import (
 	"gpdbbr/backup"
+	"gpdbbr/bklist"
 	"gpdbbr/cmd"
+	"gpdbbr/prune"
 	"gpdbbr/restore"
 	"gpdbbr/rowchk"
-	"log"
+	"gpdbbr/synth"
+	"gpdbbr/verify"
 	"os"
-	"runtime/debug"
 )
 
 func main() {
-	// 捕获异常
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("panic:", err)
-			debug.PrintStack()
-			os.Exit(1)
-		}
-	}()
+	// segment上COPY管道中的加解密过滤器, 标准输出是数据管道, 异常时直接退出
+	if len(os.Args) == 3 && (os.Args[1] == "encrypt" || os.Args[1] == "decrypt") {
+		cmd.CryptFilter(os.Args[1], os.Args[2])
+		return
+	}
+
+	// 捕获异常和中断信号, 退出前执行清理
+	defer cmd.Recover()
+	cmd.HandleSignals()
+
+	// 异常退出时发送失败通知
+	cmd.OnExit(cmd.NotifyFailed)
 
 	// 解析参数
 	cmd.ParseArg()
 
+	// 输出监控指标
+	cmd.StartMetrics()
+
 	// 备份
 	if cmd.ArgConfig.Type == "backup" {
 		backup.DoBackup()
 	} else if cmd.ArgConfig.Type == "restore" {
 		// 还原
 		restore.DoRestore()
+	} else if cmd.ArgConfig.Type == "list" {
+		// 列出备份集
+		bklist.DoList()
+	} else if cmd.ArgConfig.Type == "prune" {
+		// 清理过期备份集
+		prune.DoPrune()
+	} else if cmd.ArgConfig.Type == "synthesize" {
+		// 合成全量备份
+		synth.DoSynth()
+	} else if cmd.ArgConfig.Type == "verify" {
+		// 校验备份集
+		verify.DoVerify()
 	} else {
 		rowchk.DoRowChk()
 	}
+
+	cmd.Exit(0)
 }
@@ -0,0 +1,199 @@
+package prune
+
+import (
+	"context"
+	"gpdbbr/cmd"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func DoPrune() {
+	// 清理时不能有备份或合成任务正在写入
+	if !cmd.ArgConfig.DryRun {
+		cmd.AcquireBkLock(cmd.ArgConfig.BreakLock)
+	}
+
+	cmd.LogInfo("Checking backup sets to prune")
+	s3client := cmd.CreS3Client()
+
+	var err error
+	BkSets, err = cmd.ListBkSets(s3client)
+	if err != nil {
+		cmd.LogError("Failed to list backup sets: %s", err.Error())
+		cmd.Exit(1)
+	}
+
+	if len(BkSets) == 0 {
+		cmd.LogInfo("No backup found")
+		return
+	}
+
+	for i, set := range BkSets {
+		bkmeta, err := cmd.GetBkMeta(s3client, set)
+		if err != nil {
+			if cmd.IsNoSuchKey(err) {
+				// 没有jobinfo文件的备份集不能作为还原起点
+				SetTypes = append(SetTypes, "incomplete")
+				continue
+			}
+			cmd.LogError("Failed to read backup metadata file(%s): %s", cmd.BkSetMetaFile(set), err.Error())
+			cmd.Exit(1)
+		}
+		SetTypes = append(SetTypes, cmd.GetBkType(bkmeta, i == 0))
+	}
+
+	getkeepfrom(s3client)
+
+	if KeepFrom == 0 {
+		cmd.LogInfo("No backup set need to prune")
+		return
+	}
+
+	for _, set := range BkSets[:KeepFrom] {
+		removeset(s3client, set)
+	}
+
+	if cmd.ArgConfig.DryRun {
+		cmd.LogInfo("Dry run complete, %d backup sets would be removed", KeepFrom)
+	} else {
+		cmd.LogInfo("Prune complete, %d backup sets removed", KeepFrom)
+	}
+}
+
+// 计算需要保留的第一个备份集, 之前的备份集全部删除
+func getkeepfrom(s3client *minio.Client) {
+	KeepFrom = len(BkSets)
+
+	// 最新的全量备份链必须保留, 没有全量备份时全部保留
+	newestfull := 0
+	for i := len(BkSets) - 1; i >= 0; i-- {
+		if SetTypes[i] == "full" {
+			newestfull = i
+			break
+		}
+	}
+	keepset(newestfull, "newest backup chain")
+
+	if cmd.ArgConfig.KeepLast > 0 {
+		keepset(len(BkSets)-cmd.ArgConfig.KeepLast, "keep-last")
+	}
+
+	if cmd.ArgConfig.KeepFulls > 0 {
+		var fullidx []int
+		for i, settype := range SetTypes {
+			if settype == "full" {
+				fullidx = append(fullidx, i)
+			}
+		}
+		if len(fullidx) > cmd.ArgConfig.KeepFulls {
+			keepset(fullidx[len(fullidx)-cmd.ArgConfig.KeepFulls], "keep-fulls")
+		} else {
+			keepset(0, "keep-fulls")
+		}
+	}
+
+	if cmd.ArgConfig.KeepDays > 0 {
+		deadline := time.Now().AddDate(0, 0, -cmd.ArgConfig.KeepDays)
+		for i, set := range BkSets {
+			settime, err := time.ParseInLocation("20060102150405", set.Time[:14], time.Local)
+			if err != nil || !settime.Before(deadline) {
+				keepset(i, "keep-days")
+				break
+			}
+		}
+	}
+
+	// 备集群还未还原的备份集必须保留
+	// 备集群第一次还原之后才会上报进度, 新的备集群从最新的全量备份开始还原, 该备份链总是保留
+	standbys, err := cmd.ListStandbys(s3client)
+	if err != nil {
+		cmd.LogError("Failed to list standby restore information: %s", err.Error())
+		cmd.Exit(1)
+	}
+	for _, standby := range standbys {
+		if ignorestandby(standby) {
+			continue
+		}
+		for i, set := range BkSets {
+			if set.Date+set.Time > standby.RestoreDate+standby.RestoreTime {
+				keepset(i, "standby "+standby.Host+" not restored")
+				break
+			}
+		}
+	}
+
+	// 保留的第一个备份集必须是全量备份, 否则无法作为还原起点
+	for KeepFrom > 0 && SetTypes[KeepFrom] != "full" {
+		KeepFrom--
+	}
+}
+
+// 指定忽略或者长时间没有上报还原进度的备集群不再保留备份集, 避免下线的备集群导致备份集永远无法删除
+func ignorestandby(standby cmd.StandbyInfo) bool {
+	for _, host := range cmd.ArgConfig.IgnoreStandby {
+		if host == standby.Host {
+			cmd.LogInfo("Ignoring standby %s, restored to %s", standby.Host, standby.RestoreTime)
+			return true
+		}
+	}
+
+	if cmd.ArgConfig.StandbyMaxAge > 0 {
+		updatetime, err := cmd.ParseBkTime(standby.UpdateTime)
+		if err != nil || updatetime.Before(time.Now().AddDate(0, 0, -cmd.ArgConfig.StandbyMaxAge)) {
+			cmd.LogInfo("Ignoring standby %s, last reported at %s, restored to %s", standby.Host, standby.UpdateTime, standby.RestoreTime)
+			return true
+		}
+	}
+	return false
+}
+
+func keepset(idx int, reason string) {
+	if idx < 0 {
+		idx = 0
+	}
+	if idx < KeepFrom {
+		KeepFrom = idx
+		cmd.LogInfo("Keep backup sets from %s, reason: %s", BkSets[idx].Time, reason)
+	}
+}
+
+// 删除备份集, 先删除jobinfo文件, 中断后备份集会被视为未完成
+func removeset(s3client *minio.Client, set cmd.BkSet) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metafile := cmd.BkSetMetaFile(set)
+	var keys []string
+	objects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
+		Prefix:    cmd.BkSetPrefix(set),
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			cmd.LogError("Failed to list backup set objects(%s): %s", cmd.BkSetPrefix(set), object.Err.Error())
+			cmd.Exit(1)
+		}
+		if object.Key == metafile {
+			keys = append([]string{object.Key}, keys...)
+		} else {
+			keys = append(keys, object.Key)
+		}
+	}
+
+	for _, key := range keys {
+		if cmd.ArgConfig.DryRun {
+			cmd.LogInfo("Would remove %s", key)
+			continue
+		}
+		err := s3client.RemoveObject(ctx, cmd.ArgConfig.S3Bucket, key, minio.RemoveObjectOptions{})
+		if err != nil {
+			cmd.LogError("Failed to remove s3 object(%s): %s", key, err.Error())
+			cmd.Exit(1)
+		}
+	}
+
+	if !cmd.ArgConfig.DryRun {
+		cmd.LogInfo("Removed backup set %s, %d objects", set.Time, len(keys))
+	}
+}
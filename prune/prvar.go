@@ -0,0 +1,9 @@
+package prune
+
+import "gpdbbr/cmd"
+
+var (
+	BkSets   []cmd.BkSet // 备份集列表
+	SetTypes []string    // 备份集类型
+	KeepFrom int         // 保留的第一个备份集下标
+)
@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/minio/minio-go/v7"
 	"gopkg.in/yaml.v3"
 )
@@ -21,12 +22,20 @@ func DoRestore() {
 	isbk := getrstype()
 	if !isbk {
 		cmd.LogInfo("Restore completed successfully")
+		cmd.Notify(cmd.Notification{Status: "success", Message: "No new backup to restore"})
 		return
 	}
 
-	commrestore()
+	if RestoreType == "increment" && BkYaml.JobInfo.SynthFrom != "" {
+		// 合成的全量备份和来源备份集的数据一致, 增量还原时直接跳过
+		cmd.LogInfo("Backup %s is synthesized from %s, skip restoring", RestoreTime, BkYaml.JobInfo.SynthFrom)
+		RestoreRpt.BeginTime = time.Now().Format("20060102150405000")
+	} else {
+		commrestore()
+	}
 
 	// 写入报告信息
+	RestoreRpt.ChainId = BkYaml.JobInfo.ChainId
 	if len(RestoreRpt.FailTables) == 0 && len(RestoreRpt.FailDDLs) == 0 {
 		RestoreRpt.Status = "success"
 	} else {
@@ -36,27 +45,44 @@ func DoRestore() {
 	err := os.MkdirAll(fmt.Sprintf("%s/gpdbbr/%s/%s/%s/", CnDir, cmd.ArgConfig.DbName, RestoreDate, RestoreTime), 0755)
 	if err != nil {
 		cmd.LogError("Failed to create restore report dir: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	osfile := fmt.Sprintf("%s/gpdbbr/%s/%s/%s/gpdbbr_%s_report", CnDir, cmd.ArgConfig.DbName, RestoreDate, RestoreTime, RestoreTime)
 	yamldata, err := yaml.Marshal(&RestoreRpt)
 	if err != nil {
 		cmd.LogError("Failed to marshal restore report: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	err = os.WriteFile(osfile, yamldata, 0644)
 	if err != nil {
 		cmd.LogError("Failed to write restore report: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	cmd.LogInfo("Restore report: %s", osfile)
 
+	// 上报还原进度, prune时不会删除备集群还未还原的备份集
+	if RestoreRpt.Status == "success" {
+		putstandbyinfo()
+	}
+
 	if len(RestoreRpt.FailTables) > 0 || len(RestoreRpt.FailDDLs) > 0 {
 		cmd.LogInfo("Restore completed with some errors")
 	} else {
 		cmd.LogInfo("Restore completed successfully")
 	}
+	putmetrics()
 
+	// 还原报告中有失败的表时为failed, 任务本身已完成, 通知中为warning
+	status := "success"
+	if RestoreRpt.Status != "success" {
+		status = "warning"
+	}
+	cmd.Notify(cmd.Notification{
+		Timestamp:  RestoreTime,
+		Status:     status,
+		FailTables: RestoreRpt.FailTables,
+		FailDDLs:   RestoreRpt.FailDDLs,
+	})
 }
 
 func getrstype() bool {
@@ -66,11 +92,12 @@ func getrstype() bool {
 	CnDir = os.Getenv("COORDINATOR_DATA_DIRECTORY")
 	if CnDir == "" {
 		cmd.LogError("COORDINATOR_DATA_DIRECTORY environment variable not set")
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	predate := 0
 	pretime := 0
+	prechain := ""
 	rsdir := fmt.Sprintf("%s/gpdbbr/%s", CnDir, cmd.ArgConfig.DbName)
 	_, err := os.Stat(rsdir)
 	if err != nil {
@@ -79,7 +106,7 @@ func getrstype() bool {
 			cmd.LogInfo("Restore type = full restore")
 		} else {
 			cmd.LogError("Failed to get restore type: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 	} else {
 		// 校验还原目录
@@ -87,7 +114,7 @@ func getrstype() bool {
 		matches, err := filepath.Glob(pattern)
 		if err != nil {
 			cmd.LogError("Failed to check restore directory: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 
 		if len(matches) == 0 {
@@ -106,12 +133,12 @@ func getrstype() bool {
 			matches, err = filepath.Glob(pattern)
 			if err != nil {
 				cmd.LogError("Failed to check restore directory: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 
 			if len(matches) == 0 {
 				cmd.LogError("Failed to check restore directory: no timestamp dir found")
-				os.Exit(1)
+				cmd.Exit(1)
 			} else {
 				// 按文件名降序排序
 				sort.Sort(sort.Reverse(sort.StringSlice(matches)))
@@ -121,7 +148,7 @@ func getrstype() bool {
 				_, err := os.Stat(rowchkfile)
 				if err == nil {
 					cmd.LogError("Rowchk file exists, please check the log file")
-					os.Exit(1)
+					cmd.Exit(1)
 				}
 
 				prerptfile := fmt.Sprintf("%s/%d/gpdbbr_%d_report", datedir, pretime, pretime)
@@ -131,173 +158,129 @@ func getrstype() bool {
 				data, err := os.ReadFile(prerptfile)
 				if err != nil {
 					cmd.LogError("Failed to read restore report: %s", err.Error())
-					os.Exit(1)
+					cmd.Exit(1)
 				}
 
 				err = yaml.Unmarshal(data, &prerpt)
 				if err != nil {
 					cmd.LogError("Failed to parse restore report: %s", err.Error())
-					os.Exit(1)
+					cmd.Exit(1)
 				}
 
 				if prerpt.Status != "success" {
 					cmd.LogError("Previous restore failed, please check the log file")
-					os.Exit(1)
+					cmd.Exit(1)
 				}
+				prechain = prerpt.ChainId
+				// 上一次还原的备份集, 本次还原失败时指标仍然有值
+				cmd.SetSetTimeMetric("gpdbbr_last_restored_set", "Backup timestamp of the last restored set", fmt.Sprintf("%017d", pretime))
 			}
 		}
 	}
 
 	// s3校验
 	s3client := cmd.CreS3Client()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	sets, err := cmd.ListBkSets(s3client)
+	if err != nil {
+		cmd.LogError("Failed to list backup sets: %s", err.Error())
+		cmd.Exit(1)
+	}
 
-	if RestoreType == "increment" {
-		// 列出日期下的时间戳
-		var timedirs []int
-		timedirobjects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
-			Prefix:    fmt.Sprintf("%s/backups/%d/", cmd.ArgConfig.S3Folder, predate),
-			Recursive: false,
-		})
-
-		for timedir := range timedirobjects {
-			timedirname, err := strconv.Atoi(strings.Split(timedir.Key, "/")[3])
+	var rsset *cmd.BkSet
+	if RestoreType == "full" {
+		// 全量还原从最新的全量备份开始
+		for i := len(sets) - 1; i >= 0; i-- {
+			bkmeta, err := cmd.GetBkMeta(s3client, sets[i])
 			if err != nil {
-				cmd.LogError("The s3 contains unknown files: %s", timedir.Key)
-				os.Exit(1)
-			}
-			timedirs = append(timedirs, timedirname)
-		}
-
-		// 找出大于之前还原时间最小的时间戳
-		mintime := findMinGreaterThan(pretime, timedirs)
-		if mintime != -1 {
-			RestoreDate = fmt.Sprintf("%d", predate)
-			RestoreTime = fmt.Sprintf("%d", mintime)
-		} else {
-			// 列出备份目录下的日期
-			var datedirs []int
-			datedirobjects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
-				Prefix:    fmt.Sprintf("%s/backups/", cmd.ArgConfig.S3Folder),
-				Recursive: false,
-			})
-
-			for datedir := range datedirobjects {
-				datedirname, err := strconv.Atoi(strings.Split(datedir.Key, "/")[2])
-				if err != nil {
-					cmd.LogError("The s3 contains unknown files: %s", datedir.Key)
-					os.Exit(1)
+				if cmd.IsNoSuchKey(err) {
+					continue
 				}
-				datedirs = append(datedirs, datedirname)
+				cmd.LogError("Failed to read backup metadata file: %s", err.Error())
+				cmd.Exit(1)
 			}
-			// 找出大于之前还原日期最小的日期
-			mindate := findMinGreaterThan(predate, datedirs)
-			if mindate != -1 {
-				timedirs = nil
-				timedirobjects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
-					Prefix:    fmt.Sprintf("%s/backups/%d/", cmd.ArgConfig.S3Folder, mindate),
-					Recursive: false,
-				})
-
-				for timedir := range timedirobjects {
-					timedirname, err := strconv.Atoi(strings.Split(timedir.Key, "/")[3])
-					if err != nil {
-						cmd.LogError("The s3 contains unknown files: %s", timedir.Key)
-						os.Exit(1)
-					}
-					timedirs = append(timedirs, timedirname)
-				}
-				mintime := findMinGreaterThan(0, timedirs)
-				if mintime != -1 {
-					RestoreDate = fmt.Sprintf("%d", mindate)
-					RestoreTime = fmt.Sprintf("%d", mintime)
-				} else {
-					cmd.LogInfo("No backup found")
-					return false
-				}
-			} else {
-				cmd.LogInfo("No backup found")
-				return false
+			if cmd.GetBkType(bkmeta, i == 0) == "full" {
+				rsset = &sets[i]
+				break
 			}
 		}
 	} else {
-		var datedirs []int
-		datedirobjects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
-			Prefix:    fmt.Sprintf("%s/backups/", cmd.ArgConfig.S3Folder),
-			Recursive: false,
-		})
-
-		for datedir := range datedirobjects {
-			datedirname, err := strconv.Atoi(strings.Split(datedir.Key, "/")[2])
-			if err != nil {
-				cmd.LogError("The s3 contains unknown files: %s", datedir.Key)
-				os.Exit(1)
+		// 找出大于之前还原时间戳的最小备份集, 跳过中断的备份
+		prekey := fmt.Sprintf("%08d%017d", predate, pretime)
+		for i, set := range sets {
+			if set.Date+set.Time <= prekey {
+				continue
 			}
-			datedirs = append(datedirs, datedirname)
-		}
-
-		mindate := findMinGreaterThan(0, datedirs)
-		if mindate != -1 {
-			var timedirs []int
-			timedirobjects := s3client.ListObjects(ctx, cmd.ArgConfig.S3Bucket, minio.ListObjectsOptions{
-				Prefix:    fmt.Sprintf("%s/backups/%d/", cmd.ArgConfig.S3Folder, mindate),
-				Recursive: false,
-			})
-
-			for timedir := range timedirobjects {
-				timedirname, err := strconv.Atoi(strings.Split(timedir.Key, "/")[3])
-				if err != nil {
-					cmd.LogError("The s3 contains unknown files: %s", timedir.Key)
-					os.Exit(1)
+			if _, err := cmd.GetBkMeta(s3client, set); err != nil {
+				if cmd.IsNoSuchKey(err) {
+					cmd.LogInfo("Skipping incomplete backup %s", set.Time)
+					continue
 				}
-				timedirs = append(timedirs, timedirname)
+				cmd.LogError("Failed to read backup metadata file: %s", err.Error())
+				cmd.Exit(1)
 			}
-			mintime := findMinGreaterThan(0, timedirs)
-			if mintime != -1 {
-				RestoreDate = fmt.Sprintf("%d", mindate)
-				RestoreTime = fmt.Sprintf("%d", mintime)
-			} else {
-				cmd.LogInfo("No backup found")
-				return false
-			}
-		} else {
-			cmd.LogInfo("No backup found")
-			return false
+			rsset = &sets[i]
+			break
+		}
+	}
+
+	if rsset == nil {
+		cmd.LogInfo("No backup found")
+		// 没有新的备份集, 输出上一次还原的备份集, 用于发现备集群落后
+		// 同时刷新还原进度的上报时间, prune不会把仍在运行的备集群视为已下线
+		if pretime != 0 {
+			RestoreDate = fmt.Sprintf("%08d", predate)
+			RestoreTime = fmt.Sprintf("%017d", pretime)
+			putstandbyinfo()
 		}
+		return false
 	}
+	RestoreDate = rsset.Date
+	RestoreTime = rsset.Time
+	cmd.SetLogTimestamp(RestoreTime)
+
+	// 上传任务日志到备份集目录, 同一个备份集可能被多个备集群还原
+	hostname, _ := os.Hostname()
+	cmd.PutJobLogOnExit(*rsset, fmt.Sprintf("restore_%s_%s", hostname, time.Now().Format("20060102150405000")))
 
 	// 获取报告, 确保要恢复的备份任务状态是success的
-	metafile := fmt.Sprintf("%s/backups/%s/%s/gpdbbr_%s_jobinfo.yaml", cmd.ArgConfig.S3Folder, RestoreDate, RestoreTime, RestoreTime)
+	metafile := cmd.BkSetMetaFile(*rsset)
 	cmd.LogInfo("Metafile = %s", metafile)
-	backup_metadata_object, err := s3client.GetObject(ctx, cmd.ArgConfig.S3Bucket, metafile, minio.GetObjectOptions{})
+	BkYaml, err = cmd.GetBkMeta(s3client, *rsset)
 	if err != nil {
 		cmd.LogError("Failed to read backup metadata file: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
-	defer backup_metadata_object.Close()
 
-	backup_metadata, err := ioutil.ReadAll(backup_metadata_object)
-	if err != nil {
-		cmd.LogError("Failed to read backup metadata file: %s", err.Error())
-		os.Exit(1)
+	// 加密的备份集必须使用相同的密钥, 口令使用备份集记录的盐值派生密钥
+	if err := cmd.UseKeySalt(BkYaml.JobInfo.KeySalt); err != nil {
+		cmd.LogError("Failed to derive encryption key of backup %s: %s", RestoreTime, err.Error())
+		cmd.Exit(1)
 	}
-
-	if err := yaml.Unmarshal(backup_metadata, &BkYaml); err != nil {
-		cmd.LogError("Failed to read backup metadata file: %s", err.Error())
-		os.Exit(1)
+	if err := cmd.CheckKeyFingerprint(BkYaml.JobInfo.KeyFingerprint); err != nil {
+		cmd.LogError("Backup %s cannot be restored: %s", RestoreTime, err.Error())
+		cmd.Exit(1)
 	}
 
 	// 判断dbname
 	if BkYaml.JobInfo.DBName != cmd.ArgConfig.DbName {
 		cmd.LogError("Metafile dbname is %s not equal to the dbname in the command line arguments", BkYaml.JobInfo.DBName)
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
-	// 判断任务状态
+	// 判断任务状态, 备份失败的表会在下一个备份集中补充
 	if BkYaml.JobInfo.Status == "warning" {
-		cmd.LogError("Restore backup task status is warning")
-		os.Exit(1)
+		cmd.LogInfo("Restore backup task status is warning, failed tables will be restored from next backup: %s", strings.Join(BkYaml.FailTables, ", "))
+		RestoreRpt.CarriedTables = BkYaml.FailTables
+	}
+
+	// 判断备份链, 增量还原不能跨越备份链
+	if RestoreType == "increment" && BkYaml.JobInfo.ChainId != prechain {
+		if BkYaml.JobInfo.BackupType == "full" {
+			cmd.LogError("Backup %s starts a new backup chain(%s), the restored backup chain is %s, please restore it to an empty database", RestoreTime, BkYaml.JobInfo.ChainId, prechain)
+		} else {
+			cmd.LogError("Backup %s belongs to backup chain(%s), not the restored backup chain(%s)", RestoreTime, BkYaml.JobInfo.ChainId, prechain)
+		}
+		cmd.Exit(1)
 	}
 
 	cmd.LogInfo("Restore Key = %s", RestoreTime)
@@ -312,7 +295,7 @@ func commrestore() {
 	var dbversion string
 	if err := dbconn.QueryRow("select version()").Scan(&dbversion); err != nil {
 		cmd.LogError("Failed to get Database Version: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	dbvbegin := strings.Index(dbversion, "Greenplum Database ")
@@ -331,12 +314,12 @@ func commrestore() {
 	var usercnt int
 	if err := dbconn.QueryRow(fmt.Sprintf("select count(*) from pg_catalog.pg_user where usename in (%s)", usertext)).Scan(&usercnt); err != nil {
 		cmd.LogError("Failed to check user: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	if usercnt != len(BkYaml.UserList) {
 		cmd.LogError("User %s not exists", usertext)
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 全量还原, 必须是空库
@@ -344,11 +327,11 @@ func commrestore() {
 		tabcnt := 0
 		if err := dbconn.QueryRow("select count(*) from gp_toolkit.__gp_user_tables").Scan(&tabcnt); err != nil {
 			cmd.LogError("Failed to check table count: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		if tabcnt != 0 {
 			cmd.LogError("Full restore must be empty database")
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 	}
 
@@ -362,21 +345,25 @@ func commrestore() {
 		cmd.LogInfo("Droping incremental restore table")
 
 		for _, table := range BkYaml.DataEntries {
+			// 只备份了新增数据的表直接追加, 不删除
+			if table.Delta {
+				continue
+			}
 			if _, err := dbconn.Exec(fmt.Sprintf("drop table if exists %s cascade", table.TableName)); err != nil {
 				if pgErr, ok := err.(*pq.Error); ok {
 					if pgErr.Message == fmt.Sprintf(`"%s" is not a table`, strings.Split(table.TableName, ".")[1]) {
 						if _, err := dbconn.Exec(fmt.Sprintf("drop external table if exists %s cascade", table.TableName)); err != nil {
 							cmd.LogError("Drop external table %s failed: %s", table.TableName, err.Error())
-							os.Exit(1)
+							cmd.Exit(1)
 						}
 					}
 				} else {
 					cmd.LogError("Drop table %s failed: %s", table.TableName, err.Error())
-					os.Exit(1)
+					cmd.Exit(1)
 				}
 			}
 		}
-		
+
 		// 也要删除没有分区的父表
 		getnullpnamesql := `
 		SELECT pnp.nspname||'.'||parent.relname AS pname
@@ -390,7 +377,7 @@ func commrestore() {
 		rows, err := dbconn.Query(getnullpnamesql)
 		if err != nil {
 			cmd.LogError("Failed to get parent table name: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		defer rows.Close()
 
@@ -399,12 +386,12 @@ func commrestore() {
 			err = rows.Scan(&tabname)
 			if err != nil {
 				cmd.LogError("Failed to get parent table name: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 
 			if _, err := dbconn.Exec(fmt.Sprintf("drop table if exists %s cascade", tabname)); err != nil {
 				cmd.LogError("Drop table %s failed: %s", tabname, err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 		}
 	}
@@ -414,12 +401,12 @@ func commrestore() {
 	GpHome = os.Getenv("GPHOME")
 	if GpHome == "" {
 		cmd.LogError("GPHOME is not set")
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	rows, err := dbconn.Query("select distinct hostname from gp_segment_configuration where role = 'p' and content <> '-1'")
 	if err != nil {
 		cmd.LogError("Failed to get host lists: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	for rows.Next() {
@@ -427,12 +414,17 @@ func commrestore() {
 		err = rows.Scan(&host)
 		if err != nil {
 			cmd.LogError("Failed to get host lists: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		HostList = append(HostList, host)
 	}
 
+	cmd.CheckSegDirOwner(dbconn)
 	cmd.CreS3Yaml(RestoreTime, GpHome, HostList)
+	if len(cmd.CryptKey) > 0 {
+		cmd.LogInfo("Distributing encryption key to all hosts")
+		cmd.CreCryptFiles(RestoreTime, HostList)
+	}
 
 	// 执行表结构恢复
 	cmd.LogInfo("Restoring pre-data metadata")
@@ -449,40 +441,52 @@ func commrestore() {
 		metafile = fmt.Sprintf("%s/backups/%s/%s/gpdbbr_%s_all_metadata.sql", cmd.ArgConfig.S3Folder, RestoreDate, RestoreTime, RestoreTime)
 	}
 
-	// 判断是否有该文件
+	// 判断是否有该文件, 只有新增数据的增量备份集没有表结构文件
 	_, err = s3client.StatObject(ctx, cmd.ArgConfig.S3Bucket, metafile, minio.StatObjectOptions{})
 	if err != nil {
-		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			cmd.LogError("Failed to get backup metadata file: %s", err.Error())
+			cmd.Exit(1)
+		}
+		if len(BkYaml.DataEntries) == 0 {
 			cmd.LogInfo("no data need to restore")
 			return
-		} else {
-			cmd.LogError("Failed to get backup metadata file: %s", err.Error())
-			os.Exit(1)
 		}
-	}
+		cmd.LogInfo("No pre-data metadata need to restore")
+	} else {
+		cmd.LogInfo("Reading backup metadata file: %s", metafile)
+		backup_metadata_object, err := s3client.GetObject(ctx, cmd.ArgConfig.S3Bucket, metafile, minio.GetObjectOptions{})
+		if err != nil {
+			cmd.LogError("Failed to read backup metadata file: %s", err.Error())
+			cmd.Exit(1)
+		}
+		defer backup_metadata_object.Close()
 
-	cmd.LogInfo("Reading backup metadata file: %s", metafile)
-	backup_metadata_object, err := s3client.GetObject(ctx, cmd.ArgConfig.S3Bucket, metafile, minio.GetObjectOptions{})
-	if err != nil {
-		cmd.LogError("Failed to read backup metadata file: %s", err.Error())
-		os.Exit(1)
-	}
-	defer backup_metadata_object.Close()
+		sqlbinary, err := ioutil.ReadAll(backup_metadata_object)
+		if err != nil {
+			cmd.LogError("Failed to read backup metadata file: %s", err.Error())
+			cmd.Exit(1)
+		}
 
-	sqlbinary, err := ioutil.ReadAll(backup_metadata_object)
-	if err != nil {
-		cmd.LogError("Failed to read backup metadata file: %s", err.Error())
-		os.Exit(1)
-	}
+		sqlbinary, err = cmd.DecryptBytes(sqlbinary)
+		if err != nil {
+			cmd.LogError("Failed to decrypt backup metadata file: %s", err.Error())
+			cmd.Exit(1)
+		}
 
-	sqlscript := string(sqlbinary)
-	_, err = dbconn.Exec(sqlscript)
-	if err != nil {
-		cmd.LogError("Failed to execute backup metadata file sql scripts: %s", err.Error())
-		os.Exit(1)
-	}
+		sqlscript := string(sqlbinary)
+		_, err = dbconn.Exec(sqlscript)
+		if err != nil {
+			cmd.LogError("Failed to execute backup metadata file sql scripts: %s", err.Error())
+			cmd.Exit(1)
+		}
+
+		cmd.LogInfo("Pre-data metadata restore complete")
 
-	cmd.LogInfo("Pre-data metadata restore complete")
+		if RestoreType == "full" && len(BkYaml.TableFilter.IncludeTable) > 0 {
+			dropfiltered(dbconn)
+		}
+	}
 	cmd.LogInfo("Restoring table data")
 
 	tabchan := make(chan cmd.DataEntry, 1000000)
@@ -496,10 +500,11 @@ func commrestore() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			defer cmd.Recover()
 			dbconn1 := cmd.CreateDbConn(cmd.ArgConfig.DbName)
 			defer dbconn1.Close()
 			for table := range tabchan {
-				isrs := restoredata(dbconn1, table.TableName, table.AttributeString, table.OID)
+				isrs := restoredata(dbconn1, table)
 				if !isrs {
 					mu.Lock()
 					RestoreRpt.FailTables = append(RestoreRpt.FailTables, table.TableName)
@@ -524,6 +529,7 @@ func commrestore() {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
+				defer cmd.Recover()
 				dbconn1 := cmd.CreateDbConn(cmd.ArgConfig.DbName)
 				defer dbconn1.Close()
 				for ddl := range ddlchan {
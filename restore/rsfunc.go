@@ -4,36 +4,117 @@ import (
 	"database/sql"
 	"fmt"
 	"gpdbbr/cmd"
-	"math"
+	"os"
 	"time"
-)
-
-func findMinGreaterThan(initnum int, nums []int) int {
-	min := math.MaxInt64
-	for _, num := range nums {
-		if num > initnum && num < min {
-			min = num
-		}
-	}
 
-	if min == math.MaxInt64 {
-		return -1
-	}
-
-	return min
-}
+	"gopkg.in/yaml.v3"
+)
 
-func restoredata(dbconn *sql.DB, tabname string, attributest string, taboid string) bool {
+func restoredata(dbconn *sql.DB, table cmd.DataEntry) bool {
+	tabname := table.TableName
 	copysql := fmt.Sprintf(`
-	COPY %s(%s) FROM PROGRAM '%s/bin/gpbackup_s3_plugin restore_data /tmp/gpdbbr_%s_s3.yaml <SEG_DATA_DIR>/backups/%s/%s/gpdbbr_<SEGID>_%s_%s.gz | gzip -d -c' WITH CSV DELIMITER ',' ON SEGMENT;
-	`, tabname, attributest, GpHome, RestoreTime, RestoreDate, RestoreTime, RestoreTime, taboid)
+	COPY %s(%s) FROM PROGRAM '%s%s/bin/gpbackup_s3_plugin restore_data /tmp/gpdbbr_%s_s3.yaml <SEG_DATA_DIR>/backups/%s/%s/%s%s%s' WITH CSV DELIMITER ',' ON SEGMENT;
+	`, tabname, table.AttributeString, cmd.S3PluginEnv(RestoreTime), GpHome, RestoreTime, RestoreDate, RestoreTime, cmd.DataFileName("<SEGID>", RestoreTime, table.FileId(), table.Codec()), cmd.DecryptPipe(RestoreTime, table.Encrypted), cmd.DecompressPipe(table.Codec()))
 	timestart := time.Now()
 	_, err := dbconn.Exec(copysql)
 	if err != nil {
-		cmd.LogInfo("Failed to restore table %s, error: %s", tabname, err.Error())
+		cmd.LogErrorFields(cmd.LogFields{Table: tabname, Error: err.Error()}, "Failed to restore table %s, error: %s", tabname, err.Error())
 		return false
 	}
 	duratime := time.Since(timestart).Seconds()
-	cmd.LogInfo("Restore table %s success, duration: %.2f seconds", tabname, duratime)
+	if table.Delta {
+		cmd.LogInfoFields(cmd.LogFields{Table: tabname, Duration: duratime}, "Append new rows to table %s success, duration: %.2f seconds", tabname, duratime)
+	} else {
+		cmd.LogInfoFields(cmd.LogFields{Table: tabname, Duration: duratime}, "Restore table %s success, duration: %.2f seconds", tabname, duratime)
+	}
 	return true
 }
+
+// 全量备份的表结构按schema导出, 删除不在--include-table中的表, 和备份的表数据保持一致
+// 先删除普通表和分区, 再删除没有剩余分区的父表, 被其他对象依赖的表保留为空表
+func dropfiltered(dbconn *sql.DB) {
+	cmd.LogInfo("Dropping tables not included by the backup table filter")
+	tried := make(map[string]bool)
+	for _, relkind := range []string{"r", "p"} {
+		for {
+			dropped := 0
+			rows, err := dbconn.Query(fmt.Sprintf(`
+			SELECT n.nspname||'.'||c.relname, quote_ident(n.nspname)||'.'||quote_ident(c.relname)
+			FROM pg_class c
+			JOIN pg_namespace n ON c.relnamespace = n.oid
+			WHERE c.relkind = '%s'
+			AND n.nspname NOT LIKE 'pg_temp_%%'
+			AND n.nspname NOT LIKE 'pg_toast%%'
+			AND n.nspname NOT IN ('gp_toolkit', 'information_schema', 'pg_aoseg', 'pg_bitmapindex', 'pg_catalog')
+			AND NOT EXISTS (SELECT 1 FROM pg_inherits i WHERE i.inhparent = c.oid);
+			`, relkind))
+			if err != nil {
+				cmd.LogError("Failed to get excluded tables: %s", err.Error())
+				cmd.Exit(1)
+			}
+			var tables []string
+			for rows.Next() {
+				var tabname, quoted string
+				if err := rows.Scan(&tabname, &quoted); err != nil {
+					cmd.LogError("Failed to get excluded tables: %s", err.Error())
+					cmd.Exit(1)
+				}
+				if !cmd.MatchFilter(BkYaml.TableFilter, tabname) && !tried[quoted] {
+					tables = append(tables, quoted)
+				}
+			}
+			rows.Close()
+
+			for _, tabname := range tables {
+				tried[tabname] = true
+				if _, err := dbconn.Exec(fmt.Sprintf("drop table %s", tabname)); err != nil {
+					cmd.LogInfo("Keeping excluded table %s empty: %s", tabname, err.Error())
+					continue
+				}
+				dropped++
+			}
+			// 多级分区删除子表之后, 上一级的父表才没有分区
+			if relkind == "r" || dropped == 0 {
+				break
+			}
+		}
+	}
+}
+
+// 输出还原的监控指标
+func putmetrics() {
+	restored := len(BkYaml.DataEntries) - len(RestoreRpt.FailTables)
+	cmd.SetMetric("gpdbbr_restore_tables", "Tables restored by the job", map[string]string{"status": "restored"}, float64(restored))
+	cmd.SetMetric("gpdbbr_restore_tables", "Tables restored by the job", map[string]string{"status": "failed"}, float64(len(RestoreRpt.FailTables)))
+	cmd.SetMetric("gpdbbr_restore_failed_ddls", "DDL statements failed during restore", nil, float64(len(RestoreRpt.FailDDLs)))
+	if RestoreRpt.Status == "success" {
+		cmd.SetSetTimeMetric("gpdbbr_last_restored_set", "Backup timestamp of the last restored set", RestoreTime)
+	} else {
+		cmd.SetJobSuccess(false)
+	}
+}
+
+// 上报备集群的还原进度到s3
+func putstandbyinfo() {
+	hostname, err := os.Hostname()
+	if err != nil {
+		cmd.LogError("Failed to get hostname: %s", err.Error())
+		cmd.Exit(1)
+	}
+
+	standby := cmd.StandbyInfo{
+		Host:        hostname,
+		DBName:      cmd.ArgConfig.DbName,
+		RestoreDate: RestoreDate,
+		RestoreTime: RestoreTime,
+		UpdateTime:  time.Now().Format("20060102150405000"),
+	}
+
+	yamldata, err := yaml.Marshal(&standby)
+	if err != nil {
+		cmd.LogError("Failed to marshal standby information: %s", err.Error())
+		cmd.Exit(1)
+	}
+
+	cmd.PutDataToS3(yamldata, cmd.StandbyFile(hostname, cmd.ArgConfig.DbName))
+}
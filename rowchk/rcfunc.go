@@ -1,5 +1,10 @@
 package rowchk
 
+import (
+	"fmt"
+	"gpdbbr/cmd"
+)
+
 // 校验数据
 func checkdata(ma, mb map[string]float64) (onlya []string, onlyb []string, diffkey []DiffRowS) {
 	mbKeys := make(map[string]struct{})
@@ -29,3 +34,30 @@ func checkdata(ma, mb map[string]float64) (onlya []string, onlyb []string, diffk
 
 	return
 }
+
+// 发送行数校验结果通知, 有差异时为warning
+func notifyresult(isdo bool) {
+	if !isdo {
+		cmd.Notify(cmd.Notification{Status: "success", Message: "No restore to check"})
+		return
+	}
+
+	result := &cmd.RowCheckResult{
+		OnlyBackup: append([]string{}, TabCk.OnlyBk...),
+		OnlyDb:     append([]string{}, TabCk.OnlyDb...),
+		DiffRows:   []string{},
+	}
+	for _, diff := range TabCk.DiffRow {
+		result.DiffRows = append(result.DiffRows, diff.TabName)
+	}
+
+	status := "success"
+	if len(TabCk.OnlyBk) > 0 || len(TabCk.OnlyDb) > 0 || len(TabCk.DiffRow) > 0 {
+		status = "warning"
+	}
+	cmd.Notify(cmd.Notification{
+		Timestamp: fmt.Sprintf("%d", CkTime),
+		Status:    status,
+		RowCheck:  result,
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -21,6 +22,9 @@ func DoRowChk() {
 
 	if isdo {
 		docheck()
+		cmd.SetMetric("gpdbbr_rowcheck_differences", "Tables with row check differences", map[string]string{"kind": "only_backup"}, float64(len(TabCk.OnlyBk)))
+		cmd.SetMetric("gpdbbr_rowcheck_differences", "Tables with row check differences", map[string]string{"kind": "only_db"}, float64(len(TabCk.OnlyDb)))
+		cmd.SetMetric("gpdbbr_rowcheck_differences", "Tables with row check differences", map[string]string{"kind": "row_count"}, float64(len(TabCk.DiffRow)))
 		if len(TabCk.OnlyBk) == 0 && len(TabCk.OnlyDb) == 0 && len(TabCk.DiffRow) == 0 {
 			cmd.LogInfo("Row check success")
 		} else {
@@ -29,17 +33,20 @@ func DoRowChk() {
 			yamldata, err := yaml.Marshal(&TabCk)
 			if err != nil {
 				cmd.LogError("Failed to marshal rowchk report: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 			err = os.WriteFile(rowchkrpt, yamldata, 0644)
 			if err != nil {
 				cmd.LogError("Failed to write rowchk report: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 			cmd.LogInfo("Restore report: %s", rowchkrpt)
 			cmd.LogInfo("Row check complete, but some table has problem")
+			cmd.SetJobSuccess(false)
 		}
 	}
+
+	notifyresult(isdo)
 }
 
 func getbaseinfo() bool {
@@ -48,7 +55,7 @@ func getbaseinfo() bool {
 	CnDir = os.Getenv("COORDINATOR_DATA_DIRECTORY")
 	if CnDir == "" {
 		cmd.LogError("COORDINATOR_DATA_DIRECTORY environment variable not set")
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	ckdate := 0
@@ -61,7 +68,7 @@ func getbaseinfo() bool {
 			return false
 		} else {
 			cmd.LogError("Failed to get Restore info directory: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 	} else {
 		// 校验还原目录
@@ -69,7 +76,7 @@ func getbaseinfo() bool {
 		matches, err := filepath.Glob(pattern)
 		if err != nil {
 			cmd.LogError("Failed to get Restore info directory: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 
 		if len(matches) == 0 {
@@ -85,7 +92,7 @@ func getbaseinfo() bool {
 			matches, err = filepath.Glob(pattern)
 			if err != nil {
 				cmd.LogError("Failed to get Restore info directory: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 
 			if len(matches) == 0 {
@@ -104,18 +111,18 @@ func getbaseinfo() bool {
 				data, err := os.ReadFile(rptfile)
 				if err != nil {
 					cmd.LogError("Failed to read report file: %s", err.Error())
-					os.Exit(1)
+					cmd.Exit(1)
 				}
 
 				err = yaml.Unmarshal(data, &rpt)
 				if err != nil {
 					cmd.LogError("Failed to parse report file: %s", err.Error())
-					os.Exit(1)
+					cmd.Exit(1)
 				}
 
 				if rpt.Status != "success" {
 					cmd.LogError("Backup failed, skip rowchk")
-					os.Exit(1)
+					cmd.Exit(1)
 				}
 			}
 		}
@@ -132,32 +139,32 @@ func getbaseinfo() bool {
 	backup_metadata_object, err := s3client.GetObject(ctx, cmd.ArgConfig.S3Bucket, metafile, minio.GetObjectOptions{})
 	if err != nil {
 		cmd.LogError("Failed to read backup metadata file: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer backup_metadata_object.Close()
 
 	backup_metadata, err := ioutil.ReadAll(backup_metadata_object)
 	if err != nil {
 		cmd.LogError("Failed to read backup metadata file: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
+	}
+
+	backup_metadata, err = cmd.DecryptBytes(backup_metadata)
+	if err != nil {
+		cmd.LogError("Failed to decrypt backup metadata file: %s", err.Error())
+		cmd.Exit(1)
 	}
 
 	// 解析文件
 	if err := yaml.Unmarshal(backup_metadata, &BkMeta); err != nil {
 		cmd.LogError("Failed to read backup metadata file: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	// 判断dbname
 	if BkMeta.JobInfo.DBName != cmd.ArgConfig.DbName {
 		cmd.LogError("Metafile dbname is %s not equal to the dbname in the command line arguments", BkMeta.JobInfo.DBName)
-		os.Exit(1)
-	}
-
-	// 判断任务状态
-	if BkMeta.JobInfo.Status == "warning" {
-		cmd.LogError("Backup task status is warning, skip rowchk")
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 
 	return true
@@ -173,14 +180,14 @@ func docheck() {
 		err := dbconn.QueryRow("select count(*) from pg_stat_progress_analyze").Scan(&isdone)
 		if err != nil {
 			cmd.LogError("Failed to query pg_stat_progress_analyze: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
 		}
 		if isdone == 0 {
 			time.Sleep(3 * time.Second)
 			err = dbconn.QueryRow("select count(*) from pg_stat_progress_analyze").Scan(&isdone)
 			if err != nil {
 				cmd.LogError("Failed to query pg_stat_progress_analyze: %s", err.Error())
-				os.Exit(1)
+				cmd.Exit(1)
 			}
 			if isdone == 0 {
 				break
@@ -189,10 +196,22 @@ func docheck() {
 		time.Sleep(10 * time.Second)
 	}
 
-	rows, err := dbconn.Query("select schemaname||'.'||relname as tabname, n_live_tup as tabrow from pg_stat_all_tables where schemaname not in ('logddl', 'information_schema') and schemaname not like 'pg%'")
+	// 备份失败的表由下一个备份集补充, 不做校验
+	failtabs := make(map[string]bool)
+	for _, tabname := range BkMeta.FailTables {
+		failtabs[strings.ReplaceAll(tabname, "\"", "")] = true
+	}
+
+	// 命令行没有指定过滤条件时, 使用备份时的过滤条件
+	filter := cmd.ArgConfig.Filter
+	if filter.IsEmpty() {
+		filter = BkMeta.TableFilter
+	}
+
+	rows, err := dbconn.Query("select schemaname||'.'||relname as tabname, n_live_tup as tabrow from pg_stat_all_tables where schemaname not in ('logddl', 'information_schema') and schemaname not like 'pg%' " + cmd.FilterSql(filter, "schemaname", "relname"))
 	if err != nil {
 		cmd.LogError("Failed to query table row count: %s", err.Error())
-		os.Exit(1)
+		cmd.Exit(1)
 	}
 	defer rows.Close()
 
@@ -203,12 +222,21 @@ func docheck() {
 		err = rows.Scan(&tabname, &tabrow)
 		if err != nil {
 			cmd.LogError("Failed to scan table row count: %s", err.Error())
-			os.Exit(1)
+			cmd.Exit(1)
+		}
+		if !failtabs[tabname] {
+			tabrows[tabname] = tabrow
+		}
+	}
+
+	bkrows := make(map[string]float64)
+	for tabname, tabrow := range BkMeta.TableRows {
+		if cmd.MatchFilter(filter, tabname) && !failtabs[tabname] {
+			bkrows[tabname] = tabrow
 		}
-		tabrows[tabname] = tabrow
 	}
 
-	onlya, onlyb, diff := checkdata(BkMeta.TableRows, tabrows)
+	onlya, onlyb, diff := checkdata(bkrows, tabrows)
 
 	if len(onlya) > 0 {
 		for _, table := range onlya {
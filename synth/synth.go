@@ -0,0 +1,270 @@
+package synth
+
+import (
+	"fmt"
+	"gpdbbr/cmd"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"gopkg.in/yaml.v3"
+)
+
+func DoSynth() {
+	// 合成时备份链不能被其他任务修改
+	cmd.AcquireBkLock(cmd.ArgConfig.BreakLock)
+
+	s3client := cmd.CreS3Client()
+
+	isdo := getchain(s3client)
+	if !isdo {
+		return
+	}
+
+	// 新的备份集时间戳
+	SynthSet.Time = strings.Replace(time.Now().Format("20060102150405.000"), ".", "", 1)
+	SynthSet.Date = SynthSet.Time[:8]
+	lastset := ChainSets[len(ChainSets)-1]
+	cmd.LogInfo("Synthesizing full backup %s from %s to %s", SynthSet.Time, ChainSets[0].Time, lastset.Time)
+
+	// 合并数据项, 每张表取最新包含它的备份集
+	tasks := mergeentries(s3client)
+
+	// 元数据文件直接使用最新备份集的全量元数据
+	lastmeta := ChainMeta[len(ChainMeta)-1]
+	tasks = append(tasks, CopyTask{
+		SrcKey: fmt.Sprintf("%sgpdbbr_%s_all_metadata.sql", cmd.BkSetPrefix(lastset), lastset.Time),
+		DstKey: fmt.Sprintf("%sgpdbbr_%s_all_metadata.sql", cmd.BkSetPrefix(SynthSet), SynthSet.Time),
+	})
+
+	cmd.LogInfo("Copying %d s3 objects", len(tasks))
+	copyobjects(s3client, tasks)
+
+	// 记录复制后的数据文件
+	synthobjects, err := cmd.ListDataObjects(s3client, SynthSet)
+	if err != nil {
+		cmd.LogError("Failed to list backup set objects(%s): %s", cmd.BkSetPrefix(SynthSet), err.Error())
+		removeset(s3client)
+		cmd.Exit(1)
+	}
+	for i := range SynthMeta.DataEntries {
+		SynthMeta.DataEntries[i].Objects = synthobjects[SynthMeta.DataEntries[i].FileId()]
+	}
+
+	// 写入jobinfo, 增量信息沿用最新备份集, 之后的增量备份可以直接基于合成的备份集
+	SynthMeta.JobInfo = cmd.JobInfo{
+		Status:     "success",
+		DBName:     lastmeta.JobInfo.DBName,
+		BackupType: "full",
+		ChainId:    lastmeta.JobInfo.ChainId,
+		BeginTime:  SynthSet.Time,
+		EndTime:    time.Now().Format("20060102150405000"),
+		SynthFrom:  lastset.Time,
+		// 备份链中所有备份集使用相同的密钥
+		KeyFingerprint: lastmeta.JobInfo.KeyFingerprint,
+		KeySalt:        lastmeta.JobInfo.KeySalt,
+	}
+	SynthMeta.IncrementalMetadata = lastmeta.IncrementalMetadata
+	SynthMeta.UserList = lastmeta.UserList
+	SynthMeta.TableRows = lastmeta.TableRows
+	SynthMeta.SegSnapshots = lastmeta.SegSnapshots
+
+	yamldata, err := yaml.Marshal(&SynthMeta)
+	if err != nil {
+		cmd.LogError("Failed to marshal synthetic backup metadata: %s", err.Error())
+		removeset(s3client)
+		cmd.Exit(1)
+	}
+
+	cmd.LogInfo("Write backup job information to %s", cmd.BkSetMetaFile(SynthSet))
+	cmd.PutDataToS3(yamldata, cmd.BkSetMetaFile(SynthSet))
+	cmd.LogInfo("Synthesize completed successfully")
+}
+
+// 获取最新的备份链: 最新的全量备份及其之后的增量备份
+func getchain(s3client *minio.Client) bool {
+	cmd.LogInfo("Checking newest backup chain")
+	sets, err := cmd.ListBkSets(s3client)
+	if err != nil {
+		cmd.LogError("Failed to list backup sets: %s", err.Error())
+		cmd.Exit(1)
+	}
+
+	if len(sets) == 0 {
+		cmd.LogInfo("No backup found")
+		return false
+	}
+
+	for i, set := range sets {
+		bkmeta, err := cmd.GetBkMeta(s3client, set)
+		if err != nil {
+			if cmd.IsNoSuchKey(err) {
+				cmd.LogInfo("Skipping incomplete backup %s", set.Time)
+				continue
+			}
+			cmd.LogError("Failed to read backup metadata file(%s): %s", cmd.BkSetMetaFile(set), err.Error())
+			cmd.Exit(1)
+		}
+
+		if cmd.GetBkType(bkmeta, i == 0) == "full" {
+			ChainSets = nil
+			ChainMeta = nil
+		}
+		ChainSets = append(ChainSets, set)
+		ChainMeta = append(ChainMeta, bkmeta)
+	}
+
+	for _, bkmeta := range ChainMeta {
+		if bkmeta.JobInfo.DBName != cmd.ArgConfig.DbName {
+			cmd.LogError("Metafile dbname(%s) not equal to the dbname in the command line arguments", bkmeta.JobInfo.DBName)
+			cmd.Exit(1)
+		}
+	}
+
+	// 合成的备份集只记录一个密钥指纹, 备份链中更换过密钥时不能合成
+	fingerprint := ChainMeta[0].JobInfo.KeyFingerprint
+	for i, bkmeta := range ChainMeta {
+		if bkmeta.JobInfo.KeyFingerprint != fingerprint {
+			cmd.LogError("Backup %s is encrypted with key %q, but backup %s with key %q, can not synthesize across different keys", ChainSets[0].Time, fingerprint, ChainSets[i].Time, bkmeta.JobInfo.KeyFingerprint)
+			cmd.Exit(1)
+		}
+	}
+
+	// jobinfo使用备份链的密钥加密
+	lastmeta := ChainMeta[len(ChainMeta)-1]
+	if err := cmd.UseKeySalt(lastmeta.JobInfo.KeySalt); err != nil {
+		cmd.LogError("Failed to derive encryption key of the backup chain: %s", err.Error())
+		cmd.Exit(1)
+	}
+	if err := cmd.CheckKeyFingerprint(fingerprint); err != nil {
+		cmd.LogError("Can not synthesize the backup chain: %s", err.Error())
+		cmd.Exit(1)
+	}
+
+	// 中间备份集失败的表已经在之后的备份集中补充, 只要求最新的备份集是成功的
+	lastset := ChainSets[len(ChainSets)-1]
+	if status := lastmeta.JobInfo.Status; status != "success" {
+		cmd.LogError("Backup %s status is %s, can not synthesize", lastset.Time, status)
+		cmd.Exit(1)
+	}
+
+	if len(ChainSets) == 1 {
+		cmd.LogInfo("Newest backup set %s is already a full backup", ChainSets[0].Time)
+		return false
+	}
+
+	return true
+}
+
+// 合并数据项, 返回需要复制的s3对象
+func mergeentries(s3client *minio.Client) []CopyTask {
+	lastmeta := ChainMeta[len(ChainMeta)-1]
+
+	// 最新备份集中存在的表
+	curtables := make(map[string]bool)
+	for tabname := range lastmeta.IncrementalMetadata.AO {
+		curtables[tabname] = true
+	}
+	for tabname := range lastmeta.IncrementalMetadata.Heap {
+		curtables[tabname] = true
+	}
+
+	// 从新到旧查找每张表最新的数据项
+	// 只备份了新增数据的表需要继续向前查找, 直到找到完整的数据项
+	var tasks []CopyTask
+	found := make(map[string]bool)
+	for i := len(ChainSets) - 1; i >= 0; i-- {
+		set := ChainSets[i]
+		var setobjects map[string][]cmd.DataObject
+		var fulltables []string
+		for _, entry := range ChainMeta[i].DataEntries {
+			if !curtables[entry.TableName] {
+				continue
+			}
+			if !entry.Delta {
+				fulltables = append(fulltables, entry.TableName)
+			}
+
+			// 最新的数据项沿用原来的文件名, 更早的新增数据加上备份集时间戳避免重名
+			srcid := entry.FileId()
+			dstid := srcid
+			if found[entry.TableName] {
+				dstid = fmt.Sprintf("%s-%s", srcid, set.Time)
+				entry.FileKey = dstid
+			}
+			found[entry.TableName] = true
+			SynthMeta.DataEntries = append(SynthMeta.DataEntries, entry)
+
+			if setobjects == nil {
+				var err error
+				setobjects, err = cmd.ListDataObjects(s3client, set)
+				if err != nil {
+					cmd.LogError("Failed to list backup set objects(%s): %s", cmd.BkSetPrefix(set), err.Error())
+					cmd.Exit(1)
+				}
+			}
+			for _, object := range setobjects[srcid] {
+				tasks = append(tasks, CopyTask{
+					SrcKey: cmd.BkSetPrefix(set) + cmd.DataFileName(object.SegId, set.Time, srcid, entry.Codec()),
+					DstKey: cmd.BkSetPrefix(SynthSet) + cmd.DataFileName(object.SegId, SynthSet.Time, dstid, entry.Codec()),
+				})
+			}
+		}
+		for _, tabname := range fulltables {
+			delete(curtables, tabname)
+		}
+	}
+
+	if len(curtables) > 0 {
+		for tabname := range curtables {
+			cmd.LogError("Table %s has no data in backup chain", tabname)
+		}
+		cmd.Exit(1)
+	}
+
+	return tasks
+}
+
+// 并行复制s3对象, 失败时清理已复制的对象
+func copyobjects(s3client *minio.Client, tasks []CopyTask) {
+	taskchan := make(chan CopyTask, len(tasks))
+	for _, task := range tasks {
+		taskchan <- task
+	}
+	close(taskchan)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed bool
+	for i := 0; i < cmd.ArgConfig.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cmd.Recover()
+			for task := range taskchan {
+				err := cmd.CopyS3Object(s3client, task.SrcKey, task.DstKey)
+				if err != nil {
+					cmd.LogError("Failed to copy s3 object %s to %s: %s", task.SrcKey, task.DstKey, err.Error())
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed {
+		removeset(s3client)
+		cmd.Exit(1)
+	}
+}
+
+// 清理未完成的合成备份集
+func removeset(s3client *minio.Client) {
+	cmd.LogInfo("Removing incomplete synthetic backup %s", SynthSet.Time)
+	if err := cmd.RemoveS3Prefix(s3client, cmd.BkSetPrefix(SynthSet)); err != nil {
+		cmd.LogError("Failed to remove synthetic backup objects: %s", err.Error())
+	}
+}
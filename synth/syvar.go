@@ -0,0 +1,16 @@
+package synth
+
+import "gpdbbr/cmd"
+
+// 复制任务
+type CopyTask struct {
+	SrcKey string
+	DstKey string
+}
+
+var (
+	ChainSets []cmd.BkSet      // 最新备份链
+	ChainMeta []cmd.BkMetaData // 最新备份链的元数据
+	SynthSet  cmd.BkSet        // 合成的全量备份集
+	SynthMeta cmd.BkMetaData   // 合成的全量备份元数据
+)
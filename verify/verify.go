@@ -0,0 +1,184 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"gpdbbr/cmd"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func DoVerify() {
+	s3client := cmd.CreS3Client()
+	sets, err := cmd.ListBkSets(s3client)
+	if err != nil {
+		cmd.LogError("Failed to list backup sets: %s", err.Error())
+		cmd.Exit(1)
+	}
+
+	// 指定时间戳时只校验该备份集, 否则校验所有完成的备份集
+	var found bool
+	for i, set := range sets {
+		if cmd.ArgConfig.Timestamp == "" || set.Time == cmd.ArgConfig.Timestamp {
+			verifyset(s3client, set, i == 0)
+			found = true
+		}
+	}
+	if !found {
+		cmd.LogError("No backup to verify")
+		cmd.Exit(1)
+	}
+
+	if cmd.ArgConfig.Deep {
+		cmd.LogInfo("Reading %d data files", len(DeepTasks))
+		deepverify(s3client)
+	}
+
+	if len(Problems) > 0 {
+		cmd.LogError("Verify found %d problems in %d data files", len(Problems), Checked)
+		cmd.Exit(1)
+	}
+	cmd.LogInfo("Verify completed successfully, %d data files checked", Checked)
+}
+
+func addproblem(format string, v ...interface{}) {
+	ProblemMu.Lock()
+	defer ProblemMu.Unlock()
+	problem := fmt.Sprintf(format, v...)
+	Problems = append(Problems, problem)
+	cmd.LogError("%s", problem)
+}
+
+// 校验单个备份集的文件是否存在以及大小是否一致
+func verifyset(s3client *minio.Client, set cmd.BkSet, isfirst bool) {
+	bkmeta, err := cmd.GetBkMeta(s3client, set)
+	if err != nil {
+		if cmd.IsNoSuchKey(err) {
+			cmd.LogInfo("Skipping incomplete backup %s", set.Time)
+			return
+		}
+		addproblem("Backup %s: failed to read jobinfo: %s", set.Time, err.Error())
+		return
+	}
+	cmd.LogInfo("Verifying backup %s, %d data entries", set.Time, len(bkmeta.DataEntries))
+
+	if cmd.GetBkType(bkmeta, isfirst) == "full" {
+		metafile := fmt.Sprintf("%sgpdbbr_%s_all_metadata.sql", cmd.BkSetPrefix(set), set.Time)
+		if _, err := s3client.StatObject(context.Background(), cmd.ArgConfig.S3Bucket, metafile, minio.StatObjectOptions{}); err != nil {
+			addproblem("Backup %s: metadata file %s: %s", set.Time, metafile, err.Error())
+		}
+	}
+
+	setobjects, err := cmd.ListDataObjects(s3client, set)
+	if err != nil {
+		addproblem("Backup %s: failed to list data files: %s", set.Time, err.Error())
+		return
+	}
+
+	for _, entry := range bkmeta.DataEntries {
+		found := make(map[string]cmd.DataObject)
+		for _, object := range setobjects[entry.FileId()] {
+			found[object.SegId] = object
+		}
+
+		// 旧版本的备份集没有记录数据文件, 只能按segment数量检查
+		expected := entry.Objects
+		if len(expected) == 0 {
+			if len(found) == 0 || (len(bkmeta.SegSnapshots) > 0 && len(found) != len(bkmeta.SegSnapshots)) {
+				addproblem("Backup %s: table %s has %d data files", set.Time, entry.TableName, len(found))
+			}
+			for _, object := range found {
+				expected = append(expected, object)
+			}
+		}
+
+		for _, object := range expected {
+			Checked++
+			key := cmd.BkSetPrefix(set) + cmd.DataFileName(object.SegId, set.Time, entry.FileId(), entry.Codec())
+			actual, ok := found[object.SegId]
+			if !ok {
+				addproblem("Backup %s: table %s data file %s is missing", set.Time, entry.TableName, key)
+				continue
+			}
+			if actual.Size != object.Size {
+				addproblem("Backup %s: table %s data file %s size is %d, expected %d", set.Time, entry.TableName, key, actual.Size, object.Size)
+				continue
+			}
+			if object.ETag != "" && actual.ETag != object.ETag {
+				addproblem("Backup %s: table %s data file %s etag is %s, expected %s", set.Time, entry.TableName, key, actual.ETag, object.ETag)
+				continue
+			}
+			if cmd.ArgConfig.Deep {
+				DeepTasks = append(DeepTasks, DeepTask{Set: set, Entry: entry, Key: key})
+			}
+		}
+	}
+}
+
+// 并行读取数据文件, 解密解压后确认可读
+func deepverify(s3client *minio.Client) {
+	taskchan := make(chan DeepTask, len(DeepTasks))
+	for _, task := range DeepTasks {
+		taskchan <- task
+	}
+	close(taskchan)
+
+	var wg sync.WaitGroup
+	for i := 0; i < cmd.ArgConfig.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cmd.Recover()
+			for task := range taskchan {
+				if err := readobject(s3client, task); err != nil {
+					addproblem("Backup %s: table %s data file %s is not readable: %s", task.Set.Time, task.Entry.TableName, task.Key, err.Error())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// 读取单个数据文件
+func readobject(s3client *minio.Client, task DeepTask) error {
+	object, err := s3client.GetObject(context.Background(), cmd.ArgConfig.S3Bucket, task.Key, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	var reader io.Reader = object
+	if task.Entry.Encrypted {
+		if len(cmd.CryptKey) == 0 {
+			return fmt.Errorf("data file is encrypted, an encryption key is required")
+		}
+		pipereader, pipewriter := io.Pipe()
+		defer pipereader.Close()
+		go func() {
+			defer cmd.Recover()
+			pipewriter.CloseWithError(cmd.DecryptStream(cmd.CryptKey, object, pipewriter))
+		}()
+		reader = pipereader
+	}
+
+	// 使用和还原相同的解压程序
+	decompress := strings.TrimPrefix(cmd.DecompressPipe(task.Entry.Codec()), " | ")
+	if decompress == "" {
+		_, err = io.Copy(io.Discard, reader)
+		return err
+	}
+	args := strings.Fields(decompress)
+	oscmd := exec.Command(args[0], args[1:]...)
+	oscmd.Stdin = reader
+	oscmd.Stdout = io.Discard
+	var stderr strings.Builder
+	oscmd.Stderr = &stderr
+	if err := oscmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
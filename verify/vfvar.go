@@ -0,0 +1,20 @@
+package verify
+
+import (
+	"gpdbbr/cmd"
+	"sync"
+)
+
+// 需要深度校验的数据文件
+type DeepTask struct {
+	Set   cmd.BkSet
+	Entry cmd.DataEntry
+	Key   string
+}
+
+var (
+	Problems  []string   // 校验发现的问题
+	ProblemMu sync.Mutex // 问题列表锁
+	Checked   int        // 校验的数据文件数量
+	DeepTasks []DeepTask // 需要深度校验的数据文件
+)